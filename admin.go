@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var errNoAdmin = fmt.Errorf("the NR admin handler is not enabled")
+
+// AdminConfig enables the admin handler
+type AdminConfig struct {
+	// Token is the bearer token required by the admin handler
+	Token string `json:"token"`
+}
+
+type adminStatus struct {
+	Config    Config           `json:"config"`
+	Connected bool             `json:"connected"`
+	Settings  Settings         `json:"settings"`
+	Counters  map[string]int64 `json:"counters"`
+}
+
+// AdminHandler returns the handler for inspecting and changing the instrumentation at
+// runtime. GET requests return the effective config (with the license masked), the status
+// of the connection, the runtime settings and the self-observability counters. PATCH requests
+// apply a SettingsUpdate and return the same status. Every request must be authenticated
+// with the configured token as a bearer token
+func AdminHandler() (http.Handler, error) {
+	if app == nil {
+		return nil, errNoApp
+	}
+	if app.Config.Admin == nil {
+		return nil, errNoAdmin
+	}
+	token := []byte("Bearer " + app.Config.Admin.Token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPatch:
+			var update SettingsUpdate
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, err := UpdateSettings(update); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, PATCH")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(currentAdminStatus())
+	}), nil
+}
+
+func currentAdminStatus() adminStatus {
+	cfg := currentConfig()
+	cfg.License = maskLicense(cfg.License)
+	// the transport and the logger are not serializable
+	cfg.Transport = nil
+	cfg.Logger = nil
+	if u, err := url.Parse(cfg.ProxyURL); err == nil && u.User != nil {
+		u.User = url.User(u.User.Username())
+		cfg.ProxyURL = u.String()
+	}
+	if cfg.Admin != nil {
+		cfg.Admin = &AdminConfig{Token: "********"}
+	}
+	if cfg.Deployment != nil {
+		deployment := *cfg.Deployment
+		deployment.APIKey = maskLicense(deployment.APIKey)
+		cfg.Deployment = &deployment
+	}
+	if len(cfg.Apps) > 0 {
+		apps := make(map[string]AppConfig, len(cfg.Apps))
+		for name, appConf := range cfg.Apps {
+			appConf.License = maskLicense(appConf.License)
+			apps[name] = appConf
+		}
+		cfg.Apps = apps
+	}
+
+	return adminStatus{
+		Config:    cfg,
+		Connected: app.WaitForConnection(0) == nil,
+		Settings:  CurrentSettings(),
+		Counters:  counterValues(),
+	}
+}
+
+func maskLicense(license string) string {
+	if len(license) <= 4 {
+		return strings.Repeat("*", len(license))
+	}
+	return strings.Repeat("*", len(license)-4) + license[len(license)-4:]
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/newrelic/go-agent"
+)
+
+const (
+	apdexZoneAttribute      = "apdex.zone"
+	apdexThresholdAttribute = "apdex.threshold"
+	apdexMetricPrefix       = "KrakenD/Apdex"
+
+	apdexSatisfied  = "satisfied"
+	apdexTolerating = "tolerating"
+	apdexFrustrated = "frustrated"
+)
+
+// apdex classifies the requests of an endpoint with its own threshold, since the agent
+// only supports a single server-side Apdex T
+type apdex struct {
+	threshold time.Duration
+	metric    string
+}
+
+// endpointApdex returns the apdex settings of the endpoint or false if it has no threshold
+func endpointApdex(cfg *config.EndpointConfig) (apdex, bool) {
+	// the invalid thresholds are reset by EndpointConfigGetter and logged by HandlerFactory
+	endpointCfg, _ := EndpointConfigGetter(cfg.ExtraConfig)
+	if endpointCfg.ApdexThreshold == "" {
+		return apdex{}, false
+	}
+	threshold, err := time.ParseDuration(endpointCfg.ApdexThreshold)
+	if err != nil {
+		return apdex{}, false
+	}
+	return apdex{
+		threshold: threshold,
+		metric:    apdexMetricPrefix + cfg.Endpoint,
+	}, true
+}
+
+func (a apdex) zone(d time.Duration, failed bool) string {
+	switch {
+	case failed || d > 4*a.threshold:
+		return apdexFrustrated
+	case d > a.threshold:
+		return apdexTolerating
+	}
+	return apdexSatisfied
+}
+
+func (a apdex) report(tx newrelic.Transaction, d time.Duration, failed bool) {
+	zone := a.zone(d, failed)
+	tx.AddAttribute(apdexZoneAttribute, zone)
+	tx.AddAttribute(apdexThresholdAttribute, a.threshold.Seconds())
+	recordCustomMetric(tx, a.metric+"/"+zone, 1)
+}
@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/proxy"
+	"github.com/gin-gonic/gin"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestApdex_okZone(t *testing.T) {
+	a := apdex{threshold: 10 * time.Millisecond}
+
+	for _, tc := range []struct {
+		duration time.Duration
+		failed   bool
+		expected string
+	}{
+		{duration: time.Millisecond, expected: apdexSatisfied},
+		{duration: 10 * time.Millisecond, expected: apdexSatisfied},
+		{duration: 11 * time.Millisecond, expected: apdexTolerating},
+		{duration: 40 * time.Millisecond, expected: apdexTolerating},
+		{duration: 41 * time.Millisecond, expected: apdexFrustrated},
+		{duration: time.Millisecond, failed: true, expected: apdexFrustrated},
+	} {
+		if zone := a.zone(tc.duration, tc.failed); zone != tc.expected {
+			t.Errorf("%s (failed: %v): unexpected zone. have: %s, want: %s", tc.duration, tc.failed, zone, tc.expected)
+		}
+	}
+}
+
+func TestEndpointApdex_ok(t *testing.T) {
+	for _, threshold := range []interface{}{nil, "", "wrong", "-1s"} {
+		cfg := &config.EndpointConfig{
+			Endpoint: "/reports",
+			ExtraConfig: config.ExtraConfig{
+				Namespace: map[string]interface{}{"apdexT": threshold},
+			},
+		}
+		if _, ok := endpointApdex(cfg); ok {
+			t.Errorf("%v: unexpected apdex", threshold)
+		}
+	}
+
+	a, ok := endpointApdex(&config.EndpointConfig{
+		Endpoint: "/reports",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{"apdexT": "2s"},
+		},
+	})
+	if !ok {
+		t.Error("the apdex should be defined")
+		return
+	}
+	if a.threshold != 2*time.Second {
+		t.Errorf("unexpected threshold: %s", a.threshold)
+	}
+	if a.metric != "KrakenD/Apdex/reports" {
+		t.Errorf("unexpected metric: %s", a.metric)
+	}
+}
+
+func TestEndpointConfigGetter_koWrongApdexThreshold(t *testing.T) {
+	for _, threshold := range []string{"wrong", "-1s", "0s"} {
+		_, err := EndpointConfigGetter(config.ExtraConfig{
+			Namespace: map[string]interface{}{"apdexT": threshold},
+		})
+		if err == nil {
+			t.Errorf("%s: it should have errored", threshold)
+		}
+	}
+
+	if _, err := EndpointConfigGetter(config.ExtraConfig{
+		Namespace: map[string]interface{}{"apdexT": "250ms"},
+	}); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+}
+
+func TestHandlerFactory_okApdex(t *testing.T) {
+	nrApp := newApp()
+	defer func() { app = nil }()
+	metrics := map[string]float64{}
+	nrApp.recordCustomMetric = func(name string, value float64) error {
+		metrics[name] += value
+		return nil
+	}
+	attributes := map[string]interface{}{}
+	nrApp.startTransaction = func(name string, w http.ResponseWriter, r *http.Request) newrelic.Transaction {
+		tx := newTx()
+		tx.addAttribute = func(key string, value interface{}) error {
+			attributes[key] = value
+			return nil
+		}
+		return tx
+	}
+	app = &Application{nrApp, Config{InstrumentationRate: 100}}
+
+	status := http.StatusOK
+	handler := func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Status(status)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	mw, err := Middleware()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	router.GET("/cache", mw, HandlerFactory(handler)(&config.EndpointConfig{
+		Endpoint: "/cache",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{"apdexT": "1h"},
+		},
+	}, proxy.NoopProxy))
+
+	req, _ := http.NewRequest("GET", "/cache", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if attributes[apdexZoneAttribute] != apdexSatisfied {
+		t.Errorf("unexpected zone: %v", attributes[apdexZoneAttribute])
+	}
+	if attributes[apdexThresholdAttribute] != 3600.0 {
+		t.Errorf("unexpected threshold: %v", attributes[apdexThresholdAttribute])
+	}
+
+	status = http.StatusInternalServerError
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if attributes[apdexZoneAttribute] != apdexFrustrated {
+		t.Errorf("unexpected zone: %v", attributes[apdexZoneAttribute])
+	}
+
+	if metrics["KrakenD/Apdex/cache/satisfied"] != 1 || metrics["KrakenD/Apdex/cache/frustrated"] != 1 {
+		t.Errorf("unexpected metrics: %v", metrics)
+	}
+}
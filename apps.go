@@ -0,0 +1,305 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/newrelic/go-agent"
+	"github.com/newrelic/go-agent/_integrations/nrgin/v1"
+)
+
+var (
+	namedApps map[string]newrelic.Application
+
+	endpointRoutes = &endpointTable{}
+)
+
+// AppConfig defines a named NewRelic app and the requests routed to it. The requests of the
+// endpoints declaring the app in their config are routed to it first, then the requests with
+// one of the hosts and, finally, the requests with one of the path prefixes (the longest one
+// wins). The rest of the requests are recorded by the default app. The named apps are created
+// with the agent config of the default app when the module is registered
+type AppConfig struct {
+	// AppName is the name of the app in NewRelic
+	AppName string `json:"appName"`
+	// License of the app. Defaults to the license of the default app
+	License string `json:"license"`
+	// Rate is the instrumentation rate of the requests routed to the app. Defaults to the
+	// global rate, including its changes at runtime
+	Rate *int `json:"rate"`
+	// Hosts routed to the app, matched against the Host header without the port
+	Hosts []string `json:"hosts"`
+	// PathPrefixes routed to the app
+	PathPrefixes []string `json:"pathPrefixes"`
+}
+
+func (a AppConfig) validate(name string) error {
+	if a.AppName == "" {
+		return fmt.Errorf("the app %s requires an appName", name)
+	}
+	if a.Rate != nil && !validRate(*a.Rate) {
+		return fmt.Errorf("invalid rate for the app %s: %d", name, *a.Rate)
+	}
+	return nil
+}
+
+// startNamedApps creates the named apps with the agent config of the default app. The
+// apps that can not be created are logged and their requests are recorded by the default app
+func startNamedApps(conf Config, logger logging.Logger) map[string]newrelic.Application {
+	if len(conf.Apps) == 0 {
+		return nil
+	}
+	nrConf, err := agentConfig(conf)
+	if err != nil {
+		logger.Warning("unable to start the NR apps:", err.Error())
+		return nil
+	}
+	apps := make(map[string]newrelic.Application, len(conf.Apps))
+	for name, appConf := range conf.Apps {
+		appNRConf := nrConf
+		appNRConf.AppName = appConf.AppName
+		if appConf.License != "" {
+			appNRConf.License = appConf.License
+		}
+		nrApp, err := newApplication(appNRConf)
+		if err != nil {
+			logger.Warning("unable to start the NR app", name+":", err.Error())
+			continue
+		}
+		apps[name] = nrApp
+	}
+	return apps
+}
+
+// replaceNamedApps shuts down the named apps of the previous registration and starts the
+// ones of the config
+func replaceNamedApps(conf Config, logger logging.Logger) {
+	shutdownNamedApps(reloadShutdownTimeout)
+	namedApps = startNamedApps(conf, logger)
+}
+
+func shutdownNamedApps(timeout time.Duration) {
+	for _, nrApp := range namedApps {
+		nrApp.Shutdown(timeout)
+	}
+}
+
+// routedApp is a named app ready to start the transactions of the requests routed to it. The
+// apps without their own rate sample the requests with the current global rate
+type routedApp struct {
+	rate       *int
+	middleware gin.HandlerFunc
+}
+
+type prefixRoute struct {
+	prefix string
+	app    *routedApp
+}
+
+// appRouter selects the named app recording a request
+type appRouter struct {
+	apps     map[string]*routedApp
+	hosts    map[string]*routedApp
+	prefixes []prefixRoute
+}
+
+func newAppRouter(conf Config, apps map[string]newrelic.Application) *appRouter {
+	router := &appRouter{
+		apps:  map[string]*routedApp{},
+		hosts: map[string]*routedApp{},
+	}
+	for name, appConf := range conf.Apps {
+		nrApp, ok := apps[name]
+		if !ok {
+			continue
+		}
+		if conf.RequestID != nil {
+			nrApp = requestIDApplication{Application: nrApp, cfg: *conf.RequestID}
+		}
+		routed := &routedApp{rate: appConf.Rate, middleware: nrgin.Middleware(nrApp)}
+		router.apps[name] = routed
+		for _, host := range appConf.Hosts {
+			router.hosts[strings.ToLower(host)] = routed
+		}
+		for _, prefix := range appConf.PathPrefixes {
+			router.prefixes = append(router.prefixes, prefixRoute{prefix: prefix, app: routed})
+		}
+	}
+	sort.SliceStable(router.prefixes, func(i, j int) bool {
+		return len(router.prefixes[i].prefix) > len(router.prefixes[j].prefix)
+	})
+	return router
+}
+
+// route returns the named app recording the request of the endpoint or nil for the default app
+func (a *appRouter) route(r *http.Request, endpoint endpointRoute) *routedApp {
+	if len(a.apps) == 0 {
+		return nil
+	}
+	if routed, ok := a.apps[endpoint.app]; ok {
+		return routed
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if routed, ok := a.hosts[strings.ToLower(host)]; ok {
+		return routed
+	}
+	for _, p := range a.prefixes {
+		if strings.HasPrefix(r.URL.Path, p.prefix) {
+			return p.app
+		}
+	}
+	return nil
+}
+
+type endpointRoute struct {
+	method   string
+	endpoint string
+	pattern  []string
+	app      string
+}
+
+// endpointTable keeps the endpoints of the handlers created with HandlerFactory, so the
+// Middleware knows the endpoint of a request (its sampling rate and its named app) before
+// the request is routed. The endpoints are indexed in a tree of path segments per method,
+// rebuilt when an endpoint is registered, so the lookups do not lock
+type endpointTable struct {
+	mu     sync.Mutex
+	routes []endpointRoute
+	trees  atomic.Value
+}
+
+// endpointNode is a path segment of the tree. A request is matched against the static
+// segments first, then against the :param ones and, finally, against the *param ones
+type endpointNode struct {
+	static   map[string]*endpointNode
+	param    *endpointNode
+	catchAll *endpointRoute
+	route    *endpointRoute
+}
+
+func (e *endpointTable) register(method, endpoint, app string) {
+	method = strings.ToUpper(method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.routes = append(e.routes, endpointRoute{
+		method:   method,
+		endpoint: endpoint,
+		pattern:  pathSegments(endpoint),
+		app:      app,
+	})
+
+	trees := map[string]*endpointNode{}
+	for _, route := range e.routes {
+		root, ok := trees[route.method]
+		if !ok {
+			root = &endpointNode{}
+			trees[route.method] = root
+		}
+		root.insert(route)
+	}
+	e.trees.Store(trees)
+}
+
+// lookup returns the endpoint matching the request. As in the router, the static segments
+// take precedence over the params
+func (e *endpointTable) lookup(method, path string) (endpointRoute, bool) {
+	trees, _ := e.trees.Load().(map[string]*endpointNode)
+	root, ok := trees[method]
+	if !ok {
+		return endpointRoute{}, false
+	}
+	if route := root.lookup(pathSegments(path)); route != nil {
+		return *route, true
+	}
+	return endpointRoute{}, false
+}
+
+func (e *endpointTable) reset() {
+	e.mu.Lock()
+	e.routes = nil
+	e.trees.Store(map[string]*endpointNode{})
+	e.mu.Unlock()
+}
+
+// insert adds the route to the tree. The first route registered for a pattern wins
+func (n *endpointNode) insert(route endpointRoute) {
+	for _, segment := range route.pattern {
+		switch {
+		case strings.HasPrefix(segment, "*"):
+			if n.catchAll == nil {
+				n.catchAll = &route
+			}
+			return
+		case strings.HasPrefix(segment, ":"):
+			if n.param == nil {
+				n.param = &endpointNode{}
+			}
+			n = n.param
+		default:
+			if n.static == nil {
+				n.static = map[string]*endpointNode{}
+			}
+			child, ok := n.static[segment]
+			if !ok {
+				child = &endpointNode{}
+				n.static[segment] = child
+			}
+			n = child
+		}
+	}
+	if n.route == nil {
+		n.route = &route
+	}
+}
+
+func (n *endpointNode) lookup(segments []string) *endpointRoute {
+	if len(segments) == 0 {
+		if n.route != nil {
+			return n.route
+		}
+		return n.catchAll
+	}
+	if child, ok := n.static[segments[0]]; ok {
+		if route := child.lookup(segments[1:]); route != nil {
+			return route
+		}
+	}
+	if n.param != nil {
+		if route := n.param.lookup(segments[1:]); route != nil {
+			return route
+		}
+	}
+	return n.catchAll
+}
+
+func pathSegments(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// recordCustomMetric records the metric in the app of the transaction, so the metrics of
+// the requests routed to a named app are recorded by that app
+func recordCustomMetric(tx newrelic.Transaction, name string, value float64) {
+	if tx != nil {
+		if nrApp := tx.Application(); nrApp != nil {
+			nrApp.RecordCustomMetric(name, value)
+			return
+		}
+	}
+	if app != nil {
+		app.RecordCustomMetric(name, value)
+	}
+}
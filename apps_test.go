@@ -0,0 +1,290 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+	"github.com/gin-gonic/gin"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestConfigGetter_koWrongApps(t *testing.T) {
+	for _, apps := range []map[string]interface{}{
+		{"products": map[string]interface{}{"license": "123456"}},
+		{"products": map[string]interface{}{"appName": "products", "rate": 101}},
+	} {
+		cfg := config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"appName": "test",
+				"license": "123456",
+				"apps":    apps,
+			},
+		}
+		if _, err := ConfigGetter(cfg); err == nil {
+			t.Errorf("it should have errored: %v", apps)
+		}
+	}
+}
+
+func TestStartNamedApps_ok(t *testing.T) {
+	defer func() { newApplication = newrelic.NewApplication }()
+	confs := map[string]newrelic.Config{}
+	newApplication = func(c newrelic.Config) (newrelic.Application, error) {
+		if c.AppName == "broken" {
+			return nil, errors.New("unavailable")
+		}
+		confs[c.AppName] = c
+		return newApp(), nil
+	}
+
+	conf := Config{Config: newrelic.NewConfig("gateway", testLicense)}
+	conf.Apps = map[string]AppConfig{
+		"products": {AppName: "products"},
+		"payments": {AppName: "payments", License: "0987654321098765432109876543210987654321"},
+		"broken":   {AppName: "broken"},
+	}
+
+	buff := &bytes.Buffer{}
+	logger, _ := logging.NewLogger("DEBUG", buff, "pref")
+	apps := startNamedApps(conf, logger)
+
+	if len(apps) != 2 {
+		t.Errorf("unexpected apps: %v", apps)
+	}
+	if _, ok := apps["broken"]; ok {
+		t.Error("the broken app should not be started")
+	}
+	if confs["products"].License != testLicense {
+		t.Errorf("unexpected license: %s", confs["products"].License)
+	}
+	if confs["payments"].License != "0987654321098765432109876543210987654321" {
+		t.Errorf("unexpected license: %s", confs["payments"].License)
+	}
+	if !bytes.Contains(buff.Bytes(), []byte("unable to start the NR app broken:")) {
+		t.Errorf("unexpected log: %s", buff.String())
+	}
+}
+
+func TestMiddleware_okNamedApps(t *testing.T) {
+	defer func() {
+		app = nil
+		namedApps = nil
+		endpointRoutes.reset()
+	}()
+
+	calls := map[string]int{}
+	countingApp := func(name string) sampleApplication {
+		nrApp := newApp()
+		nrApp.startTransaction = func(_ string, w http.ResponseWriter, r *http.Request) newrelic.Transaction {
+			calls[name]++
+			return newTx()
+		}
+		return nrApp
+	}
+
+	zero := 0
+	app = &Application{countingApp("default"), Config{
+		InstrumentationRate: 100,
+		Apps: map[string]AppConfig{
+			"products": {AppName: "products", Hosts: []string{"products.example.com"}, PathPrefixes: []string{"/products"}},
+			"payments": {AppName: "payments", PathPrefixes: []string{"/products/payments"}},
+			"internal": {AppName: "internal", Rate: &zero, PathPrefixes: []string{"/internal"}},
+			"missing":  {AppName: "missing", PathPrefixes: []string{"/missing"}},
+		},
+	}}
+	namedApps = map[string]newrelic.Application{
+		"products": countingApp("products"),
+		"payments": countingApp("payments"),
+		"internal": countingApp("internal"),
+	}
+
+	mw, err := Middleware()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handler := func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) { c.Status(http.StatusTeapot) }
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(mw)
+	router.GET("/users/:id", HandlerFactory(handler)(&config.EndpointConfig{
+		Endpoint: "/users/:id",
+		Method:   "GET",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{"app": "payments"},
+		},
+	}, nil))
+	for _, path := range []string{"/orders", "/products/list", "/products/payments/list", "/missing/list", "/internal/health"} {
+		router.GET(path, func(c *gin.Context) { c.Status(http.StatusTeapot) })
+	}
+
+	for _, tc := range []struct {
+		host, path, app string
+	}{
+		{host: "products.example.com:8080", path: "/users/42", app: "payments"},
+		{host: "Products.Example.com", path: "/orders", app: "products"},
+		{host: "gateway", path: "/products/list", app: "products"},
+		{host: "gateway", path: "/products/payments/list", app: "payments"},
+		{host: "gateway", path: "/missing/list", app: "default"},
+		{host: "gateway", path: "/orders", app: "default"},
+		{host: "gateway", path: "/internal/health", app: ""},
+	} {
+		calls = map[string]int{}
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		req.Host = tc.host
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Result().StatusCode != http.StatusTeapot {
+			t.Errorf("%s%s: unexpected status code: %d", tc.host, tc.path, w.Result().StatusCode)
+		}
+		if tc.app == "" {
+			if len(calls) != 0 {
+				t.Errorf("%s%s: the request should not be sampled: %v", tc.host, tc.path, calls)
+			}
+			continue
+		}
+		if len(calls) != 1 || calls[tc.app] != 1 {
+			t.Errorf("%s%s: unexpected apps: %v", tc.host, tc.path, calls)
+		}
+	}
+
+	// the apps without their own rate follow the global rate set at runtime
+	calls = map[string]int{}
+	if _, err := UpdateSettings(SettingsUpdate{Rate: &zero}); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	productsReq, _ := http.NewRequest("GET", "/products/list", nil)
+	router.ServeHTTP(httptest.NewRecorder(), productsReq)
+	if len(calls) != 0 {
+		t.Errorf("the request should not be sampled: %v", calls)
+	}
+
+	// the endpoint rates apply to the requests routed to the named apps too
+	calls = map[string]int{}
+	if _, err := UpdateSettings(SettingsUpdate{EndpointRates: map[string]*int{"/users/:id": &zero}}); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	req, _ := http.NewRequest("GET", "/users/42", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if len(calls) != 0 {
+		t.Errorf("the request should not be sampled: %v", calls)
+	}
+}
+
+func TestReplaceNamedApps_ok(t *testing.T) {
+	defer func() {
+		namedApps = nil
+		newApplication = newrelic.NewApplication
+	}()
+	shutdowns := map[string]int{}
+	newApplication = func(c newrelic.Config) (newrelic.Application, error) {
+		nrApp := newApp()
+		nrApp.shutdown = func(_ time.Duration) { shutdowns[c.AppName]++ }
+		return nrApp, nil
+	}
+
+	conf := Config{Config: newrelic.NewConfig("gateway", testLicense)}
+	conf.Apps = map[string]AppConfig{"products": {AppName: "products"}}
+	replaceNamedApps(conf, logging.NoOp)
+	if len(shutdowns) != 0 {
+		t.Errorf("unexpected shutdowns: %v", shutdowns)
+	}
+
+	conf.Apps = map[string]AppConfig{"payments": {AppName: "payments"}}
+	replaceNamedApps(conf, logging.NoOp)
+	if len(shutdowns) != 1 || shutdowns["products"] != 1 {
+		t.Errorf("unexpected shutdowns: %v", shutdowns)
+	}
+	if _, ok := namedApps["payments"]; !ok || len(namedApps) != 1 {
+		t.Errorf("unexpected apps: %v", namedApps)
+	}
+}
+
+func TestEndpointTable_okPatterns(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, path string
+		match         bool
+	}{
+		{pattern: "/users", path: "/users", match: true},
+		{pattern: "/users/:id", path: "/users/42", match: true},
+		{pattern: "/users/:id", path: "/users/42/orders", match: false},
+		{pattern: "/users/:id", path: "/users", match: false},
+		{pattern: "/users/:id/orders", path: "/users/42/orders", match: true},
+		{pattern: "/users/:id/orders", path: "/users/42/carts", match: false},
+		{pattern: "/static/*path", path: "/static/css/main.css", match: true},
+		{pattern: "/", path: "/", match: true},
+	} {
+		table := &endpointTable{}
+		table.register("GET", tc.pattern, "")
+		if _, ok := table.lookup("GET", tc.path); ok != tc.match {
+			t.Errorf("%s against %s: expected match %v", tc.path, tc.pattern, tc.match)
+		}
+	}
+}
+
+func TestEndpointTable_ok(t *testing.T) {
+	table := &endpointTable{}
+	table.register("get", "/users/:id", "")
+	table.register("GET", "/users/me", "profiles")
+	table.register("POST", "/users/:id", "")
+	table.register("GET", "/users/:id/orders", "")
+	table.register("", "/static/*path", "")
+
+	for _, tc := range []struct {
+		method, path, endpoint string
+	}{
+		{method: "GET", path: "/users/42", endpoint: "/users/:id"},
+		{method: "GET", path: "/users/me", endpoint: "/users/me"},
+		{method: "POST", path: "/users/me", endpoint: "/users/:id"},
+		{method: "GET", path: "/users/me/orders", endpoint: "/users/:id/orders"},
+		{method: "GET", path: "/static/css/main.css", endpoint: "/static/*path"},
+		{method: "GET", path: "/orders", endpoint: ""},
+	} {
+		route, ok := table.lookup(tc.method, tc.path)
+		if ok != (tc.endpoint != "") || route.endpoint != tc.endpoint {
+			t.Errorf("%s %s: unexpected endpoint %s", tc.method, tc.path, route.endpoint)
+		}
+	}
+	if route, _ := table.lookup("GET", "/users/me"); route.app != "profiles" {
+		t.Errorf("unexpected app: %s", route.app)
+	}
+}
+
+func TestRecordCustomMetric_ok(t *testing.T) {
+	defer func() { app = nil }()
+
+	var recorded []string
+	recordingApp := func(name string) sampleApplication {
+		nrApp := newApp()
+		nrApp.recordCustomMetric = func(metric string, _ float64) error {
+			recorded = append(recorded, name+":"+metric)
+			return nil
+		}
+		return nrApp
+	}
+	app = &Application{recordingApp("default"), Config{}}
+
+	tx := newTx()
+	recordCustomMetric(tx, "a", 1)
+	tx.application = func() newrelic.Application { return recordingApp("products") }
+	recordCustomMetric(tx, "b", 1)
+	recordCustomMetric(nil, "c", 1)
+
+	if len(recorded) != 3 || recorded[0] != "default:a" || recorded[1] != "products:b" || recorded[2] != "default:c" {
+		t.Errorf("unexpected metrics: %v", recorded)
+	}
+}
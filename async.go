@@ -0,0 +1,15 @@
+package metrics
+
+import "context"
+
+// GoroutineContext returns a copy of the received context holding a transaction handle for the
+// calling goroutine. Segments started from different handles do not share the segment stack, so
+// segments started concurrently (like the backend calls of an endpoint) are recorded as
+// siblings with their own timing. If the context has no transaction, it is returned as is
+func GoroutineContext(ctx context.Context) context.Context {
+	tx, ok := lookupTransaction(ctx)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, nrCtxKey, tx.NewGoroutine())
+}
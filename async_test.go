@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/proxy"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestGoroutineContext_okNoTransaction(t *testing.T) {
+	ctx := context.Background()
+	if GoroutineContext(ctx) != ctx {
+		t.Error("the context should not be modified")
+	}
+}
+
+func TestBackendFactory_okConcurrentBackends(t *testing.T) {
+	nrApp := newApp()
+	defer func() { app = nil }()
+	app = &Application{nrApp, Config{InstrumentationRate: 100}}
+
+	mu := new(sync.Mutex)
+	segments := map[int]int{}
+	handles := 0
+
+	txn := newTx()
+	txn.startSegmentNow = func() newrelic.SegmentStartTime {
+		t.Error("segments should not be started from the shared transaction")
+		return newrelic.SegmentStartTime{}
+	}
+	txn.newGoroutine = func() newrelic.Transaction {
+		mu.Lock()
+		handles++
+		id := handles
+		mu.Unlock()
+
+		child := newTx()
+		child.startSegmentNow = func() newrelic.SegmentStartTime {
+			mu.Lock()
+			segments[id]++
+			mu.Unlock()
+			return newrelic.SegmentStartTime{}
+		}
+		return child
+	}
+
+	totalBackends := 10
+	endpoint := &config.EndpointConfig{Endpoint: "/fan-out"}
+	bf := BackendFactory("backend", func(cfg *config.Backend) proxy.Proxy {
+		return func(ctx context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			if _, ok := ctx.Value(nrCtxKey).(newrelic.Transaction); !ok {
+				t.Error("the backend context should have a transaction")
+			}
+			time.Sleep(time.Millisecond)
+			return &proxy.Response{Data: map[string]interface{}{cfg.URLPattern: true}, IsComplete: true}, nil
+		}
+	})
+
+	backends := make([]proxy.Proxy, totalBackends)
+	for i := range backends {
+		cfg := &config.Backend{URLPattern: fmt.Sprintf("/backend/%d", i)}
+		endpoint.Backend = append(endpoint.Backend, cfg)
+		backends[i] = bf(cfg)
+	}
+
+	p := proxy.NewMergeDataMiddleware(endpoint)(backends...)
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := p(context.WithValue(context.Background(), nrCtxKey, txn), &proxy.Request{})
+			if err != nil {
+				t.Errorf("unexpected error: %s", err.Error())
+				return
+			}
+			if len(resp.Data) != totalBackends {
+				t.Errorf("unexpected response: %v", resp.Data)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if handles != 5*totalBackends {
+		t.Errorf("unexpected number of transaction handles. have: %d, want: %d", handles, 5*totalBackends)
+	}
+	if len(segments) != handles {
+		t.Errorf("unexpected number of handles with segments. have: %d, want: %d", len(segments), handles)
+	}
+	for id, total := range segments {
+		if total != 1 {
+			t.Errorf("the handle %d started %d segments", id, total)
+		}
+	}
+}
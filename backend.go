@@ -2,37 +2,89 @@ package metrics
 
 import (
 	"context"
+	"strings"
 
 	"github.com/devopsfaith/krakend/config"
 	"github.com/devopsfaith/krakend/proxy"
 	"github.com/newrelic/go-agent"
 )
 
+// maxKeyedBackends is the number of backends of a request getting attributes keyed by backend.
+// NewRelic rejects the user attributes beyond 64 per transaction, so the attributes of the rest
+// of the backends of a fan-out endpoint are not added
+const maxKeyedBackends = 4
+
 // BackendFactory creates an instrumented backend factory
 func BackendFactory(segmentName string, next proxy.BackendFactory) proxy.BackendFactory {
 	if app == nil {
 		return next
 	}
 	return func(cfg *config.Backend) proxy.Proxy {
-		return NewBackend(segmentName, next(cfg))
+		p := next(cfg)
+		p = newBackendStatusClassifier(cfg, p)
+		p = newBackendErrorClassifier(cfg, p)
+		p = NewBackend(segmentName, p)
+		p = newSequentialStep(cfg, p)
+		return withBackend(cfg, p)
+	}
+}
+
+// withBackend adds the URL pattern of the backend to the context, so the attributes recorded
+// during the call can be keyed by backend
+func withBackend(cfg *config.Backend, next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		return next(context.WithValue(ctx, backendCtxKey, cfg.URLPattern), req)
 	}
 }
 
-// NewBackend includes NewRelic segmentation
+// NewBackend includes NewRelic segmentation. The segment is started from a dedicated
+// transaction handle, so it is safe to use it in concurrent backend calls. Failed, timed out
+// and cancelled calls are tagged in the segment name
 func NewBackend(segmentName string, next proxy.Proxy) proxy.Proxy {
 	if app == nil {
 		return next
 	}
 	return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
-		tx, ok := ctx.Value(nrCtxKey).(newrelic.Transaction)
-		if !ok {
+		if _, ok := lookupTransaction(ctx); !ok {
 			return next(ctx, req)
 		}
 
-		segment := newrelic.StartSegment(tx, segmentName)
+		// the backends of an endpoint are called concurrently, so every call gets its own handle
+		ctx = GoroutineContext(ctx)
+		tx := transactionFromContext(ctx)
+		recordBackendStart(ctx)
+		segment := startSegment(tx, segmentName)
 		resp, err := next(ctx, req)
+		recordBackendOutcome(ctx, tx, segment, err)
 		segment.End()
 
 		return resp, err
 	}
 }
+
+// backendAttribute returns the name of a transaction attribute of the backend. Since the
+// backends of an endpoint are called by the same transaction, the attributes are keyed by
+// the URL pattern of the backend so they do not overwrite each other
+func backendAttribute(name, urlPattern string) string {
+	return keyedAttribute(name, backendPath(urlPattern))
+}
+
+func keyedAttribute(name, backend string) string {
+	return name + "[" + backend + "]"
+}
+
+// addBackendAttribute adds the attribute keyed by the backend unless the request proxied by
+// NewProxyMiddleware already has keyed attributes for maxKeyedBackends other backends
+func addBackendAttribute(ctx context.Context, tx newrelic.Transaction, name, backend string, value interface{}) {
+	if o, ok := ctx.Value(outcomesCtxKey).(*outcomes); ok && !o.keyed(backend) {
+		return
+	}
+	tx.AddAttribute(keyedAttribute(name, backend), value)
+}
+
+func backendPath(urlPattern string) string {
+	if !strings.HasPrefix(urlPattern, "/") {
+		return "/" + urlPattern
+	}
+	return urlPattern
+}
@@ -3,6 +3,7 @@ package metrics
 import (
 	"context"
 	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -93,3 +94,33 @@ func TestNewBackend_okAppNil(t *testing.T) {
 		t.Errorf("unexpected number of calls to the txn end. have: %d, wanted: 0", totalCalls)
 	}
 }
+
+func TestAddBackendAttribute_okMaxKeyedBackends(t *testing.T) {
+	attributes := map[string]interface{}{}
+	txn := newTx()
+	txn.addAttribute = func(key string, value interface{}) error {
+		attributes[key] = value
+		return nil
+	}
+
+	ctx := context.WithValue(context.Background(), outcomesCtxKey, newOutcomes())
+	for i := 0; i < maxKeyedBackends+2; i++ {
+		backend := fmt.Sprintf("/backend/%d", i)
+		addBackendAttribute(ctx, txn, "a", backend, i)
+		addBackendAttribute(ctx, txn, "b", backend, i)
+	}
+	if len(attributes) != 2*maxKeyedBackends {
+		t.Errorf("unexpected attributes: %v", attributes)
+	}
+	if _, ok := attributes[keyedAttribute("b", fmt.Sprintf("/backend/%d", maxKeyedBackends-1))]; !ok {
+		t.Errorf("the admitted backends should get all their attributes: %v", attributes)
+	}
+
+	attributes = map[string]interface{}{}
+	for i := 0; i < maxKeyedBackends+2; i++ {
+		addBackendAttribute(context.Background(), txn, "a", fmt.Sprintf("/backend/%d", i), i)
+	}
+	if len(attributes) != maxKeyedBackends+2 {
+		t.Errorf("unexpected attributes without the proxy middleware: %v", attributes)
+	}
+}
@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/proxy"
+	"github.com/newrelic/go-agent"
+)
+
+const (
+	concurrentCtxKey = "newRelicConcurrentCall"
+
+	concurrentAttemptsAttribute     = "concurrent.attempts"
+	concurrentSavedLatencyAttribute = "concurrent.savedLatency"
+
+	attemptWinner    = "winner"
+	attemptCancelled = "cancelled"
+	attemptFailed    = "failed"
+	attemptCompleted = "completed"
+)
+
+// NewConcurrentMiddleware returns an instrumented version of the KrakenD concurrent middleware.
+// Every attempt is recorded as a segment tagged with its outcome: the winner, the attempts
+// cancelled because of the winner, the failed ones and the ones completed without winning.
+// The transaction gets the number of attempts and the latency saved by the winner, as a lower
+// bound: the mean duration of the non-winning and non-failed attempts, counting the ones still
+// running as if they finished right now, minus the duration of the winner
+func NewConcurrentMiddleware(remote *config.Backend) proxy.Middleware {
+	mw := proxy.NewConcurrentMiddleware(remote)
+	if app == nil || remote.ConcurrentCalls < 2 {
+		return mw
+	}
+	return func(next ...proxy.Proxy) proxy.Proxy {
+		if len(next) > 1 {
+			panic(proxy.ErrTooManyProxies)
+		}
+		if len(next) == 0 {
+			panic(proxy.ErrNotEnoughProxies)
+		}
+		p := mw(newConcurrentAttempt(next[0]))
+		return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+			tx, ok := lookupTransaction(ctx)
+			if !ok {
+				return p(ctx, req)
+			}
+
+			call := &concurrentCall{winner: -1, started: time.Now()}
+			resp, err := p(context.WithValue(ctx, concurrentCtxKey, call), req)
+			call.report(tx)
+
+			return resp, err
+		}
+	}
+}
+
+func newConcurrentAttempt(next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		call, ok := ctx.Value(concurrentCtxKey).(*concurrentCall)
+		if !ok {
+			return next(ctx, req)
+		}
+
+		index := call.start()
+		ctx = GoroutineContext(ctx)
+		segment := startSegment(transactionFromContext(ctx), fmt.Sprintf("concurrent call %d", index))
+		start := time.Now()
+		resp, err := next(ctx, req)
+		outcome := call.finish(index, time.Since(start), resp, err, ctx.Err())
+		segment.Name = fmt.Sprintf("%s (%s)", segment.Name, outcome)
+		segment.End()
+
+		return resp, err
+	}
+}
+
+// concurrentCall tracks the attempts of a concurrent call
+type concurrentCall struct {
+	mu             sync.Mutex
+	started        time.Time
+	attempts       int
+	running        int
+	winner         int
+	winnerDuration time.Duration
+	losers         []time.Duration
+}
+
+func (c *concurrentCall) start() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attempts++
+	c.running++
+	return c.attempts - 1
+}
+
+func (c *concurrentCall) finish(index int, d time.Duration, resp *proxy.Response, err, ctxErr error) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running--
+
+	switch {
+	case err == nil && resp != nil && resp.IsComplete && c.winner == -1:
+		c.winner = index
+		c.winnerDuration = d
+		return attemptWinner
+	case ctxErr == context.Canceled:
+		c.losers = append(c.losers, d)
+		return attemptCancelled
+	case err != nil:
+		return attemptFailed
+	}
+
+	c.losers = append(c.losers, d)
+	return attemptCompleted
+}
+
+func (c *concurrentCall) report(tx newrelic.Transaction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tx.AddAttribute(concurrentAttemptsAttribute, c.attempts)
+	if c.winner == -1 || len(c.losers)+c.running == 0 {
+		return
+	}
+
+	total := time.Since(c.started) * time.Duration(c.running)
+	for _, d := range c.losers {
+		total += d
+	}
+	saved := total/time.Duration(len(c.losers)+c.running) - c.winnerDuration
+	if saved > 0 {
+		tx.AddAttribute(concurrentSavedLatencyAttribute, saved.Seconds())
+	}
+}
@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/proxy"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestNewConcurrentMiddleware_ok(t *testing.T) {
+	nrApp := newApp()
+	defer func() { app = nil }()
+	app = &Application{nrApp, Config{InstrumentationRate: 100}}
+
+	remote := &config.Backend{
+		ConcurrentCalls: 3,
+		Timeout:         time.Second,
+	}
+
+	mu := new(sync.Mutex)
+	attributes := map[string]interface{}{}
+	var handles int32
+	txn := newTx()
+	txn.addAttribute = func(key string, value interface{}) error {
+		mu.Lock()
+		attributes[key] = value
+		mu.Unlock()
+		return nil
+	}
+	txn.newGoroutine = func() newrelic.Transaction {
+		atomic.AddInt32(&handles, 1)
+		return newTx()
+	}
+
+	var calls int32
+	cancelled := make(chan struct{}, 2)
+	p := NewConcurrentMiddleware(remote)(func(ctx context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(10 * time.Millisecond)
+			return &proxy.Response{IsComplete: true, Data: map[string]interface{}{"ok": true}}, nil
+		}
+		<-ctx.Done()
+		cancelled <- struct{}{}
+		return nil, ctx.Err()
+	})
+
+	resp, err := p(context.WithValue(context.Background(), nrCtxKey, txn), &proxy.Request{})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if resp.Data["ok"] != true {
+		t.Errorf("unexpected response: %v", resp)
+	}
+
+	<-cancelled
+	<-cancelled
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attributes[concurrentAttemptsAttribute] != 3 {
+		t.Errorf("unexpected number of attempts: %v", attributes[concurrentAttemptsAttribute])
+	}
+	if saved, ok := attributes[concurrentSavedLatencyAttribute].(float64); ok && saved < 0 {
+		t.Errorf("unexpected saved latency: %v", saved)
+	}
+	if atomic.LoadInt32(&handles) != 3 {
+		t.Errorf("unexpected number of transaction handles: %d", handles)
+	}
+}
+
+func TestNewConcurrentMiddleware_okSingleCall(t *testing.T) {
+	nrApp := newApp()
+	defer func() { app = nil }()
+	app = &Application{nrApp, Config{InstrumentationRate: 100}}
+
+	totalCalls := 0
+	p := NewConcurrentMiddleware(&config.Backend{ConcurrentCalls: 1})(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		totalCalls++
+		return nil, nil
+	})
+	p(context.Background(), nil)
+
+	if totalCalls != 1 {
+		t.Errorf("unexpected number of calls: %d", totalCalls)
+	}
+}
+
+func TestConcurrentCall_okFinish(t *testing.T) {
+	call := &concurrentCall{winner: -1, started: time.Now()}
+	for i := 0; i < 4; i++ {
+		call.start()
+	}
+
+	incomplete := &proxy.Response{}
+	complete := &proxy.Response{IsComplete: true}
+
+	if outcome := call.finish(0, time.Millisecond, nil, errors.New("boom"), nil); outcome != attemptFailed {
+		t.Errorf("unexpected outcome: %s", outcome)
+	}
+	if outcome := call.finish(1, 2*time.Millisecond, incomplete, nil, nil); outcome != attemptCompleted {
+		t.Errorf("unexpected outcome: %s", outcome)
+	}
+	if outcome := call.finish(2, 3*time.Millisecond, complete, nil, nil); outcome != attemptWinner {
+		t.Errorf("unexpected outcome: %s", outcome)
+	}
+	if outcome := call.finish(3, 9*time.Millisecond, nil, context.Canceled, context.Canceled); outcome != attemptCancelled {
+		t.Errorf("unexpected outcome: %s", outcome)
+	}
+
+	attributes := map[string]interface{}{}
+	txn := newTx()
+	txn.addAttribute = func(key string, value interface{}) error {
+		attributes[key] = value
+		return nil
+	}
+	call.report(txn)
+
+	if attributes[concurrentAttemptsAttribute] != 4 {
+		t.Errorf("unexpected number of attempts: %v", attributes[concurrentAttemptsAttribute])
+	}
+	// (2ms + 9ms) / 2 - 3ms
+	if saved := attributes[concurrentSavedLatencyAttribute]; saved != (2500 * time.Microsecond).Seconds() {
+		t.Errorf("unexpected saved latency: %v", saved)
+	}
+}
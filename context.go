@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/newrelic/go-agent"
+)
+
+// StartSegment starts a segment in the transaction of the context. The returned segment is
+// safe to end even if the module is disabled or the request is not sampled. Use
+// GoroutineContext before starting segments from concurrent goroutines
+func StartSegment(ctx context.Context, name string) *newrelic.Segment {
+	return startSegment(transactionFromContext(ctx), name)
+}
+
+// AddAttribute adds an attribute to the transaction of the context, if any
+func AddAttribute(ctx context.Context, key string, value interface{}) {
+	if tx := transactionFromContext(ctx); tx != nil {
+		tx.AddAttribute(key, value)
+	}
+}
+
+// NoticeError reports the error in the transaction of the context, if any
+func NoticeError(ctx context.Context, err error) {
+	if tx := transactionFromContext(ctx); tx != nil && err != nil {
+		noticeError(tx, err)
+	}
+}
+
+// SetName renames the transaction of the context, if any
+func SetName(ctx context.Context, name string) {
+	if tx := transactionFromContext(ctx); tx != nil {
+		tx.SetName(name)
+	}
+}
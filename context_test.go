@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestContextHelpers_ok(t *testing.T) {
+	segments := 0
+	attributes := map[string]interface{}{}
+	errs := []error{}
+	names := []string{}
+
+	txn := newTx()
+	txn.startSegmentNow = func() newrelic.SegmentStartTime {
+		segments++
+		return newrelic.SegmentStartTime{}
+	}
+	txn.addAttribute = func(key string, value interface{}) error {
+		attributes[key] = value
+		return nil
+	}
+	txn.noticeError = func(err error) error {
+		errs = append(errs, err)
+		return nil
+	}
+	txn.setName = func(name string) error {
+		names = append(names, name)
+		return nil
+	}
+
+	ctx := context.WithValue(context.Background(), nrCtxKey, txn)
+	expectedErr := errors.New("unauthorized")
+
+	StartSegment(ctx, "auth").End()
+	AddAttribute(ctx, "user", "alice")
+	NoticeError(ctx, expectedErr)
+	NoticeError(ctx, nil)
+	SetName(ctx, "/login")
+
+	if segments != 1 {
+		t.Errorf("unexpected number of segments: %d", segments)
+	}
+	if attributes["user"] != "alice" {
+		t.Errorf("unexpected attributes: %v", attributes)
+	}
+	if len(errs) != 1 || errs[0] != expectedErr {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if len(names) != 1 || names[0] != "/login" {
+		t.Errorf("unexpected names: %v", names)
+	}
+}
+
+func TestContextHelpers_okNoTransaction(t *testing.T) {
+	ctx := context.Background()
+
+	if err := StartSegment(ctx, "auth").End(); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	AddAttribute(ctx, "user", "alice")
+	NoticeError(ctx, errors.New("unauthorized"))
+	SetName(ctx, "/login")
+}
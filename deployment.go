@@ -0,0 +1,199 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/devopsfaith/krakend/core"
+	"github.com/devopsfaith/krakend/logging"
+)
+
+// DeploymentAPIKeyEnv is the environment variable with the REST API key used when the
+// deployment config does not define one
+const DeploymentAPIKeyEnv = "NEW_RELIC_API_KEY"
+
+const (
+	defaultDeploymentUser = "krakend"
+	deploymentTimeout     = 10 * time.Second
+)
+
+var regionAPIEndpoints = map[string]string{
+	RegionUS:      "https://api.newrelic.com/v2",
+	RegionEU:      "https://api.eu.newrelic.com/v2",
+	RegionFedRAMP: "https://gov-api.newrelic.com/v2",
+}
+
+// DeploymentConfig defines the deployment marker recorded in background when the module is
+// registered. The revision of the marker is the config checksum, so a config already recorded
+// by another replica is not recorded again. The replicas starting at the same time may record
+// it twice
+type DeploymentConfig struct {
+	// ApplicationID is the id of the app in NewRelic
+	ApplicationID string `json:"applicationID"`
+	// APIKey is the REST API key. Defaults to the value of NEW_RELIC_API_KEY
+	APIKey string `json:"apiKey"`
+	// Endpoint is the base URL of the REST API. Defaults to the API of the region
+	Endpoint string `json:"endpoint"`
+	// Changelog of the deployment
+	Changelog string `json:"changelog"`
+	// Description of the deployment. Defaults to the KrakenD version
+	Description string `json:"description"`
+	// User recording the deployment. Defaults to krakend
+	User string `json:"user"`
+}
+
+func (d DeploymentConfig) validate() error {
+	if d.ApplicationID == "" {
+		return fmt.Errorf("the deployment marker requires an applicationID")
+	}
+	if d.Endpoint != "" {
+		u, err := url.Parse(d.Endpoint)
+		if err != nil {
+			return err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid deployment endpoint %s", d.Endpoint)
+		}
+	}
+	return nil
+}
+
+func (d DeploymentConfig) apiKey() string {
+	if d.APIKey != "" {
+		return d.APIKey
+	}
+	return os.Getenv(DeploymentAPIKeyEnv)
+}
+
+func (d DeploymentConfig) url(region string) string {
+	endpoint := d.Endpoint
+	if endpoint == "" {
+		endpoint = regionAPIEndpoints[RegionUS]
+		if e, ok := regionAPIEndpoints[region]; ok {
+			endpoint = e
+		}
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/applications/" + url.PathEscape(d.ApplicationID) + "/deployments.json"
+}
+
+type deployment struct {
+	Revision    string `json:"revision"`
+	Changelog   string `json:"changelog,omitempty"`
+	Description string `json:"description,omitempty"`
+	User        string `json:"user,omitempty"`
+}
+
+type deploymentRequest struct {
+	Deployment deployment `json:"deployment"`
+}
+
+type deploymentList struct {
+	Deployments []deployment `json:"deployments"`
+}
+
+// recordDeployment records the deployment marker with the given revision unless the app
+// already has a deployment with it
+func recordDeployment(conf Config, revision string, logger logging.Logger) {
+	recorded, err := postDeployment(conf, revision)
+	switch {
+	case err != nil:
+		logger.Error("unable to record the NR deployment:", err.Error())
+	case recorded:
+		logger.Info("NR deployment recorded with revision", revision)
+	default:
+		logger.Debug("NR deployment already recorded with revision", revision)
+	}
+}
+
+func postDeployment(conf Config, revision string) (bool, error) {
+	d := *conf.Deployment
+	key := d.apiKey()
+	if key == "" {
+		return false, fmt.Errorf("no REST API key defined")
+	}
+
+	client := &http.Client{Timeout: deploymentTimeout}
+	if conf.NetworkConfig != (NetworkConfig{}) {
+		transport, err := agentTransport(conf.NetworkConfig)
+		if err != nil {
+			return false, err
+		}
+		client.Transport = transport
+	}
+	u := d.url(conf.Region)
+
+	var list deploymentList
+	if err := deploymentCall(client, http.MethodGet, u, key, nil, &list); err != nil {
+		return false, err
+	}
+	for _, existing := range list.Deployments {
+		if existing.Revision == revision {
+			return false, nil
+		}
+	}
+
+	marker := deploymentRequest{Deployment: deployment{
+		Revision:    revision,
+		Changelog:   d.Changelog,
+		Description: d.Description,
+		User:        d.User,
+	}}
+	if marker.Deployment.Description == "" {
+		marker.Deployment.Description = "KrakenD " + core.KrakendVersion
+	}
+	if marker.Deployment.User == "" {
+		marker.Deployment.User = defaultDeploymentUser
+	}
+	b, err := json.Marshal(marker)
+	if err != nil {
+		return false, err
+	}
+	if err := deploymentCall(client, http.MethodPost, u, key, bytes.NewReader(b), nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func deploymentCall(client *http.Client, method, u, key string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Api-Key", key)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("unexpected status code from the deployments API: %d", resp.StatusCode)
+	}
+	if result == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// deploymentRevision returns the config checksum of the service, if available, or a checksum
+// of the config of the module
+func deploymentRevision(conf Config, cfg interface{}) (string, error) {
+	if revision, ok := conf.Labels[LabelConfigChecksum]; ok && revision != "" {
+		return revision, nil
+	}
+	return checksum(cfg)
+}
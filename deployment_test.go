@@ -0,0 +1,233 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+// deploymentsAPI is a stub of the deployments endpoint of the NewRelic REST API
+type deploymentsAPI struct {
+	mu       sync.Mutex
+	keys     []string
+	recorded []deployment
+	posted   chan deployment
+}
+
+func newDeploymentsAPI(existing ...deployment) *deploymentsAPI {
+	return &deploymentsAPI{recorded: existing, posted: make(chan deployment, 1)}
+}
+
+func (d *deploymentsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v2/applications/42/deployments.json" {
+		http.NotFound(w, r)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keys = append(d.keys, r.Header.Get("X-Api-Key"))
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(deploymentList{Deployments: d.recorded})
+	case http.MethodPost:
+		var req deploymentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		d.recorded = append(d.recorded, req.Deployment)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(req)
+		d.posted <- req.Deployment
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestPostDeployment_ok(t *testing.T) {
+	api := newDeploymentsAPI()
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	conf := Config{Deployment: &DeploymentConfig{
+		ApplicationID: "42",
+		APIKey:        "secret",
+		Endpoint:      server.URL + "/v2/",
+		Changelog:     "new backends",
+	}}
+
+	recorded, err := postDeployment(conf, "abcdef")
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if !recorded {
+		t.Error("the deployment should be recorded")
+	}
+
+	recorded, err = postDeployment(conf, "abcdef")
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if recorded {
+		t.Error("the deployment should not be recorded twice")
+	}
+
+	if len(api.recorded) != 1 {
+		t.Errorf("unexpected deployments: %v", api.recorded)
+		return
+	}
+	d := api.recorded[0]
+	if d.Revision != "abcdef" || d.Changelog != "new backends" || d.User != defaultDeploymentUser || d.Description == "" {
+		t.Errorf("unexpected deployment: %v", d)
+	}
+	for _, key := range api.keys {
+		if key != "secret" {
+			t.Errorf("unexpected API key: %s", key)
+		}
+	}
+}
+
+func TestPostDeployment_okAPIKeyFromEnv(t *testing.T) {
+	api := newDeploymentsAPI()
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	conf := Config{Deployment: &DeploymentConfig{ApplicationID: "42", Endpoint: server.URL + "/v2"}}
+
+	defer setenv(DeploymentAPIKeyEnv, "")()
+	if _, err := postDeployment(conf, "abcdef"); err == nil {
+		t.Error("it should have errored")
+	}
+
+	defer setenv(DeploymentAPIKeyEnv, "from-env")()
+	if _, err := postDeployment(conf, "abcdef"); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if len(api.keys) != 2 || api.keys[0] != "from-env" {
+		t.Errorf("unexpected API keys: %v", api.keys)
+	}
+}
+
+func TestPostDeployment_koStatusCode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	conf := Config{Deployment: &DeploymentConfig{ApplicationID: "42", APIKey: "secret", Endpoint: server.URL}}
+	if _, err := postDeployment(conf, "abcdef"); err == nil {
+		t.Error("it should have errored")
+	}
+}
+
+func TestDeploymentConfig_okURL(t *testing.T) {
+	for _, tc := range []struct {
+		cfg    DeploymentConfig
+		region string
+		url    string
+	}{
+		{cfg: DeploymentConfig{ApplicationID: "42"}, url: "https://api.newrelic.com/v2/applications/42/deployments.json"},
+		{cfg: DeploymentConfig{ApplicationID: "42"}, region: RegionEU, url: "https://api.eu.newrelic.com/v2/applications/42/deployments.json"},
+		{cfg: DeploymentConfig{ApplicationID: "42", Endpoint: "http://localhost:8080/"}, region: RegionEU, url: "http://localhost:8080/applications/42/deployments.json"},
+	} {
+		if u := tc.cfg.url(tc.region); u != tc.url {
+			t.Errorf("unexpected url. have: %s, want: %s", u, tc.url)
+		}
+	}
+}
+
+func TestConfigGetter_koWrongDeployment(t *testing.T) {
+	for _, deployment := range []map[string]interface{}{
+		{"apiKey": "secret"},
+		{"applicationID": "42", "endpoint": "localhost"},
+	} {
+		cfg := config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"appName":    "test",
+				"license":    "123456",
+				"deployment": deployment,
+			},
+		}
+		if _, err := ConfigGetter(cfg); err == nil {
+			t.Errorf("it should have errored: %v", deployment)
+		}
+	}
+}
+
+func TestRegisterService_okDeployment(t *testing.T) {
+	api := newDeploymentsAPI()
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	defer func() {
+		app = nil
+		moduleLogger = logging.NoOp
+		newApplication = newrelic.NewApplication
+	}()
+	newApplication = func(_ newrelic.Config) (newrelic.Application, error) {
+		return newApp(), nil
+	}
+
+	serviceConfig := config.ServiceConfig{
+		Name: "gateway",
+		Port: 8080,
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"appName": "test",
+				"license": testLicense,
+				"deployment": map[string]interface{}{
+					"applicationID": "42",
+					"apiKey":        "secret",
+					"endpoint":      server.URL + "/v2",
+				},
+			},
+		},
+	}
+	checksum, _ := configChecksum(serviceConfig)
+
+	buff := &bytes.Buffer{}
+	logger, _ := logging.NewLogger("DEBUG", buff, "pref")
+	RegisterService(serviceConfig, logger)
+
+	select {
+	case d := <-api.posted:
+		if d.Revision != checksum {
+			t.Errorf("unexpected revision. have: %s, want: %s", d.Revision, checksum)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the deployment was not recorded: %s", buff.String())
+	}
+}
+
+func TestDeploymentRevision_ok(t *testing.T) {
+	conf := Config{TransactionName: NamingMethodEndpoint}
+	revision, err := deploymentRevision(conf, conf)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if len(revision) != 12 {
+		t.Errorf("unexpected revision: %s", revision)
+	}
+
+	conf.TransactionName = NamingEndpoint
+	if other, _ := deploymentRevision(conf, conf); other == revision {
+		t.Error("the revision should change with the config")
+	}
+
+	conf.Labels = map[string]string{LabelConfigChecksum: "abcdef"}
+	if revision, _ = deploymentRevision(conf, conf); revision != "abcdef" {
+		t.Errorf("unexpected revision: %s", revision)
+	}
+}
@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+// Error kinds of the default classifiers
+const (
+	ErrorKindDNS               = "dns"
+	ErrorKindConnectionRefused = "connection_refused"
+	ErrorKindTLS               = "tls"
+	ErrorKindTimeout           = "timeout"
+	ErrorKindCancelled         = "cancelled"
+	ErrorKindDecoding          = "decoding"
+	ErrorKindStatusCode        = "status_code"
+	ErrorKindKrakenD           = "krakend"
+	ErrorKindUnknown           = "unknown"
+
+	errorKindAttribute       = "error.kind"
+	backendErrorMetricPrefix = "KrakenD/BackendErrors/"
+)
+
+// ErrorClassifier returns the kind of the received error or an empty string if it
+// is not able to classify it
+type ErrorClassifier func(err error) string
+
+var (
+	customErrorClassifiers   = []ErrorClassifier{}
+	customErrorClassifiersMu = new(sync.RWMutex)
+
+	krakendErrors = []error{
+		proxy.ErrNoBackends,
+		proxy.ErrTooManyBackends,
+		proxy.ErrTooManyProxies,
+		proxy.ErrNotEnoughProxies,
+	}
+)
+
+// RegisterErrorClassifier adds a classifier to the error taxonomy. The registered classifiers
+// are evaluated in order and before the default ones
+func RegisterErrorClassifier(classifier ErrorClassifier) {
+	customErrorClassifiersMu.Lock()
+	customErrorClassifiers = append(customErrorClassifiers, classifier)
+	customErrorClassifiersMu.Unlock()
+}
+
+// errorKind returns the stable kind of the error
+func errorKind(err error) string {
+	customErrorClassifiersMu.RLock()
+	for _, classifier := range customErrorClassifiers {
+		if kind := classifier(err); kind != "" {
+			customErrorClassifiersMu.RUnlock()
+			return kind
+		}
+	}
+	customErrorClassifiersMu.RUnlock()
+
+	return defaultErrorKind(err)
+}
+
+func defaultErrorKind(err error) string {
+	switch err {
+	case context.DeadlineExceeded:
+		return ErrorKindTimeout
+	case context.Canceled:
+		return ErrorKindCancelled
+	case proxy.ErrInvalidStatusCode:
+		return ErrorKindStatusCode
+	case syscall.ECONNREFUSED:
+		return ErrorKindConnectionRefused
+	}
+	for _, e := range krakendErrors {
+		if err == e {
+			return ErrorKindKrakenD
+		}
+	}
+
+	switch e := err.(type) {
+	case *url.Error:
+		return defaultErrorKind(e.Err)
+	case *net.OpError:
+		if kind := defaultErrorKind(e.Err); kind != ErrorKindUnknown {
+			return kind
+		}
+	case *os.SyscallError:
+		return defaultErrorKind(e.Err)
+	case *net.DNSError:
+		return ErrorKindDNS
+	case tls.RecordHeaderError, x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+		return ErrorKindTLS
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return ErrorKindDecoding
+	}
+
+	if t, ok := err.(interface {
+		Timeout() bool
+	}); ok && t.Timeout() {
+		return ErrorKindTimeout
+	}
+	if strings.HasPrefix(err.Error(), "tls: ") {
+		return ErrorKindTLS
+	}
+
+	return ErrorKindUnknown
+}
+
+// newBackendErrorClassifier reports the kind of the errors returned by the backend as a
+// transaction attribute keyed by backend and as a custom metric per kind and backend
+func newBackendErrorClassifier(cfg *config.Backend, next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		resp, err := next(ctx, req)
+		if err == nil {
+			return resp, err
+		}
+
+		tx, ok := lookupTransaction(ctx)
+		if !ok {
+			return resp, err
+		}
+
+		kind := errorKind(err)
+		loggerFromContext(ctx).Debug("NR backend error", backendPath(cfg.URLPattern)+":", kind, err.Error())
+		addBackendAttribute(ctx, tx, errorKindAttribute, backendPath(cfg.URLPattern), kind)
+		recordCustomMetric(tx, backendErrorMetric(kind, cfg.URLPattern), 1)
+
+		return resp, err
+	}
+}
+
+func backendErrorMetric(kind, urlPattern string) string {
+	return backendErrorMetricPrefix + kind + backendPath(urlPattern)
+}
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestErrorKind_ok(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	addr := l.Addr().String()
+	l.Close()
+	_, refused := http.Get("http://" + addr)
+
+	syntaxErr := json.Unmarshal([]byte(`{"a":`), &map[string]interface{}{})
+	typeErr := json.Unmarshal([]byte(`{"a":1}`), &map[string]string{})
+
+	for i, tc := range []struct {
+		err      error
+		expected string
+	}{
+		{err: refused, expected: ErrorKindConnectionRefused},
+		{err: &url.Error{Op: "Get", URL: "http://unknown", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Name: "unknown"}}}, expected: ErrorKindDNS},
+		{err: &url.Error{Op: "Get", URL: "https://example.com", Err: x509.UnknownAuthorityError{}}, expected: ErrorKindTLS},
+		{err: errors.New("tls: handshake failure"), expected: ErrorKindTLS},
+		{err: &url.Error{Op: "Get", URL: "http://example.com", Err: context.DeadlineExceeded}, expected: ErrorKindTimeout},
+		{err: &net.DNSError{IsTimeout: true}, expected: ErrorKindDNS},
+		{err: context.Canceled, expected: ErrorKindCancelled},
+		{err: syntaxErr, expected: ErrorKindDecoding},
+		{err: typeErr, expected: ErrorKindDecoding},
+		{err: proxy.ErrInvalidStatusCode, expected: ErrorKindStatusCode},
+		{err: proxy.ErrTooManyProxies, expected: ErrorKindKrakenD},
+		{err: errors.New("boom"), expected: ErrorKindUnknown},
+	} {
+		if kind := errorKind(tc.err); kind != tc.expected {
+			t.Errorf("%d (%v): unexpected kind. have: %s, want: %s", i, tc.err, kind, tc.expected)
+		}
+	}
+}
+
+func TestRegisterErrorClassifier_ok(t *testing.T) {
+	defer func() { customErrorClassifiers = []ErrorClassifier{} }()
+
+	RegisterErrorClassifier(func(err error) string {
+		if strings.Contains(err.Error(), "quota") {
+			return "quota"
+		}
+		return ""
+	})
+
+	if kind := errorKind(errors.New("quota exceeded")); kind != "quota" {
+		t.Errorf("unexpected kind: %s", kind)
+	}
+	if kind := errorKind(context.Canceled); kind != ErrorKindCancelled {
+		t.Errorf("unexpected kind: %s", kind)
+	}
+}
+
+func TestNewBackendErrorClassifier_ok(t *testing.T) {
+	nrApp := newApp()
+	defer func() { app = nil }()
+	metrics := map[string]float64{}
+	nrApp.recordCustomMetric = func(name string, value float64) error {
+		metrics[name] += value
+		return nil
+	}
+	app = &Application{nrApp, Config{InstrumentationRate: 100}}
+
+	attributes := map[string]interface{}{}
+	txn := newTx()
+	txn.addAttribute = func(key string, value interface{}) error {
+		attributes[key] = value
+		return nil
+	}
+
+	cfg := &config.Backend{URLPattern: "/users"}
+	p := newBackendErrorClassifier(cfg, func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return nil, &url.Error{Op: "Get", URL: "http://users", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Name: "users"}}}
+	})
+
+	other := newBackendErrorClassifier(&config.Backend{URLPattern: "/orders"}, func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return nil, context.DeadlineExceeded
+	})
+
+	ctx := context.WithValue(context.Background(), nrCtxKey, txn)
+	p(ctx, nil)
+	other(ctx, nil)
+	p(ctx, nil)
+
+	if kind := attributes[backendAttribute(errorKindAttribute, "/users")]; kind != ErrorKindDNS {
+		t.Errorf("unexpected error kind: %v", kind)
+	}
+	if kind := attributes[backendAttribute(errorKindAttribute, "/orders")]; kind != ErrorKindTimeout {
+		t.Errorf("unexpected error kind: %v", kind)
+	}
+	if metrics["KrakenD/BackendErrors/dns/users"] != 2 {
+		t.Errorf("unexpected metrics: %v", metrics)
+	}
+}
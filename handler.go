@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/newrelic/go-agent"
+)
+
+const (
+	handlerTransactionName = "gateway"
+	requestPathAttribute   = "request.path"
+)
+
+// NewHTTPHandler wraps the http.Handler with the NewRelic instrumentation, for the gateways
+// not using the gin router of this module, like the ones loading it as a plugin. The ignore
+// rules, the runtime settings (but the endpoint rates) and the request IDs are applied as in
+// the Middleware. Since the endpoints are unknown at this layer, all the transactions share
+// the same name and get the path of the request as an attribute. They are added to the
+// context of the request, so the clients created with HTTPClientFactory are instrumented
+func NewHTTPHandler(next http.Handler) (http.Handler, error) {
+	if app == nil {
+		return next, errNoApp
+	}
+
+	rules, err := newIgnoreRules(currentConfig().Ignore)
+	if err != nil {
+		return next, err
+	}
+
+	var nrApp newrelic.Application = app
+	requestID := app.Config.RequestID
+	if requestID != nil {
+		nrApp = requestIDApplication{Application: app, cfg: *requestID}
+	}
+
+	initSettings(rules)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if requestID != nil {
+			ctx = context.WithValue(ctx, requestIDCtxKey, requestIDFromRequest(*requestID, r))
+		}
+		count(counterRequests)
+		if s := currentSettings(); !s.Enabled || !appAvailable() || isIgnored(s.rules, r) || !isSampled(s.Rate) {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		txn := nrApp.StartTransaction(handlerTransactionName, w, r)
+		defer txn.End()
+		txn.AddAttribute(requestPathAttribute, r.URL.Path)
+
+		next.ServeHTTP(txn, r.WithContext(context.WithValue(ctx, nrCtxKey, txn)))
+	}), nil
+}
@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/proxy"
+	"github.com/gin-gonic/gin"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestNewHTTPHandler_ok(t *testing.T) {
+	names := []string{}
+	attributes := map[string]interface{}{}
+	nrApp := newApp()
+	defer func() { app = nil }()
+	nrApp.startTransaction = func(name string, w http.ResponseWriter, r *http.Request) newrelic.Transaction {
+		names = append(names, name)
+		tx := newTx()
+		tx.ResponseWriter = w
+		tx.addAttribute = func(key string, value interface{}) error {
+			attributes[key] = value
+			return nil
+		}
+		return tx
+	}
+
+	app = &Application{nrApp, Config{
+		InstrumentationRate: 100,
+		Ignore:              IgnoreConfig{Paths: []string{"/__health"}},
+		RequestID:           &RequestIDConfig{},
+	}}
+
+	handler, err := NewHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, hasTx := r.Context().Value(nrCtxKey).(newrelic.Transaction)
+		if hasTx != (r.URL.Path != "/__health") {
+			t.Errorf("unexpected transaction in the context of %s", r.URL.Path)
+		}
+		if id, _ := r.Context().Value(requestIDCtxKey).(string); id != r.Header.Get(DefaultRequestIDHeader) || id == "" {
+			t.Errorf("unexpected request ID in the context: %s", id)
+		}
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+
+	for _, path := range []string{"/__health", "/my_endpoint"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Result().StatusCode != http.StatusTeapot {
+			t.Errorf("unexpected status code: %d", w.Result().StatusCode)
+		}
+	}
+
+	if len(names) != 1 {
+		t.Errorf("unexpected number of calls to the txn generator. have: %d, wanted: 1", len(names))
+		return
+	}
+	if names[0] != handlerTransactionName {
+		t.Errorf("unexpected name: %s", names[0])
+	}
+	if attributes[requestPathAttribute] != "/my_endpoint" {
+		t.Errorf("unexpected attributes: %v", attributes)
+	}
+}
+
+func TestNewHTTPHandler_okDisabled(t *testing.T) {
+	defer func() { app = nil }()
+	app = &Application{newApp(), Config{}}
+
+	next := http.NotFoundHandler()
+	handler, err := NewHTTPHandler(next)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+
+	req, _ := http.NewRequest("GET", "/my_endpoint", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status code: %d", w.Result().StatusCode)
+	}
+}
+
+func TestNewHTTPHandler_koNoApp(t *testing.T) {
+	app = nil
+	if _, err := NewHTTPHandler(http.NotFoundHandler()); err != errNoApp {
+		t.Error("Should have given errNoApp error")
+	}
+}
+
+func TestNewHTTPHandler_okGinContext(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer backend.Close()
+
+	segments := 0
+	nrApp := newApp()
+	defer func() { app = nil }()
+	nrApp.startTransaction = func(name string, w http.ResponseWriter, r *http.Request) newrelic.Transaction {
+		tx := newTx()
+		tx.ResponseWriter = w
+		tx.startSegmentNow = func() newrelic.SegmentStartTime {
+			segments++
+			return newrelic.SegmentStartTime{}
+		}
+		return tx
+	}
+	app = &Application{nrApp, Config{InstrumentationRate: 100}}
+
+	cf := HTTPClientFactory(proxy.NewHTTPClient)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/my_endpoint", func(c *gin.Context) {
+		// the KrakenD endpoints pass the gin context to the proxies
+		ctx, cancel := context.WithTimeout(c, time.Second)
+		defer cancel()
+		req, _ := http.NewRequest("GET", backend.URL, nil)
+		resp, err := cf(ctx).Do(req.WithContext(ctx))
+		if err != nil {
+			t.Errorf("unexpected error: %s", err.Error())
+			return
+		}
+		resp.Body.Close()
+		c.Status(resp.StatusCode)
+	})
+
+	handler, err := NewHTTPHandler(router)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+
+	req, _ := http.NewRequest("GET", "/my_endpoint", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Result().StatusCode != http.StatusTeapot {
+		t.Errorf("unexpected status code: %d", w.Result().StatusCode)
+	}
+	if segments != 1 {
+		t.Errorf("the backend call should be recorded by the transaction of the handler: %d", segments)
+	}
+}
@@ -8,15 +8,40 @@ import (
 	"github.com/newrelic/go-agent"
 )
 
-// HTTPClientFactory includes a http.RoundTripper for NewRelic instrumentation
+// HTTPClientFactory includes a http.RoundTripper for NewRelic instrumentation. If the httpTrace
+// option is enabled, the phases of the requests (DNS lookup, connect, TLS handshake, time to
+// first byte and body read) and the reuse of the connections are also recorded. If the
+// requestID option is enabled, the request ID is forwarded to the backends.
+// The client returned by the wrapped factory is never modified: the instrumented client is a
+// copy of it, so shared clients are safe to use and the connection pool of their transport is
+// still reused
 func HTTPClientFactory(cf proxy.HTTPClientFactory) proxy.HTTPClientFactory {
 	return func(ctx context.Context) *http.Client {
 		client := cf(ctx)
 
-		if tx, ok := ctx.Value(nrCtxKey).(newrelic.Transaction); ok {
-			client.Transport = newrelic.NewRoundTripper(tx, client.Transport)
+		tx, hasTx := lookupTransaction(ctx)
+		requestID, hasRequestID := contextValue(ctx, requestIDCtxKey).(string)
+		hasRequestID = hasRequestID && app != nil && app.Config.RequestID != nil
+		if !hasTx && !hasRequestID {
+			return client
 		}
 
-		return client
+		transport := client.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		if hasRequestID {
+			transport = requestIDTransport{next: transport, header: app.Config.RequestID.header(), id: requestID}
+		}
+		if hasTx {
+			if app != nil && app.Config.HTTPTrace {
+				transport = tracedTransport{next: transport, tx: tx}
+			}
+			transport = newrelic.NewRoundTripper(tx, transport)
+		}
+
+		instrumented := *client
+		instrumented.Transport = transport
+		return &instrumented
 	}
 }
@@ -3,6 +3,9 @@ package metrics
 import (
 	"context"
 	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/devopsfaith/krakend/proxy"
@@ -29,3 +32,58 @@ func TestHTTPClientFactory_ok(t *testing.T) {
 		t.Errorf("unexpected client type %t", client2.Transport)
 	}
 }
+
+func TestHTTPClientFactory_okSharedClient(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	shared := &http.Client{Transport: transport}
+	cf := HTTPClientFactory(func(_ context.Context) *http.Client { return shared })
+
+	totalTxns := 10
+	totalRequests := 5
+	segments := make([]int32, totalTxns)
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < totalTxns; i++ {
+		txn := newTx()
+		counter := &segments[i]
+		txn.startSegmentNow = func() newrelic.SegmentStartTime {
+			atomic.AddInt32(counter, 1)
+			return newrelic.SegmentStartTime{}
+		}
+		ctx := context.WithValue(context.Background(), nrCtxKey, txn)
+
+		for j := 0; j < totalRequests; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				client := cf(ctx)
+				if client == shared {
+					t.Error("the shared client should not be returned")
+					return
+				}
+				resp, err := client.Get(s.URL)
+				if err != nil {
+					t.Errorf("unexpected error: %s", err.Error())
+					return
+				}
+				resp.Body.Close()
+			}()
+		}
+	}
+	wg.Wait()
+
+	if shared.Transport != transport {
+		t.Error("the shared client has been modified")
+	}
+	for i, total := range segments {
+		if total != int32(totalRequests) {
+			t.Errorf("unexpected number of segments for the transaction %d: %d", i, total)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/newrelic/go-agent"
+)
+
+const (
+	phaseDNS       = "dnsLookup"
+	phaseConnect   = "connect"
+	phaseTLS       = "tlsHandshake"
+	phaseFirstByte = "timeToFirstByte"
+	phaseBodyRead  = "bodyRead"
+
+	httpAttributePrefix     = "http."
+	httpConnReusedAttribute = "http.connReused"
+	httpMetricPrefix        = "KrakenD/HTTP/"
+)
+
+// tracedTransport records the phases of the HTTP requests as transaction attributes keyed by
+// backend and as custom metrics per phase and host
+type tracedTransport struct {
+	next http.RoundTripper
+	tx   newrelic.Transaction
+}
+
+func (t tracedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timings := newPhaseTimings()
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), timings.clientTrace()))
+
+	backend := tracedBackend(req)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		timings.report(req.Context(), t.tx, req.URL.Host, backend)
+		return resp, err
+	}
+
+	resp.Body = &tracedBody{
+		ReadCloser: resp.Body,
+		done: func() {
+			timings.bodyRead()
+			timings.report(req.Context(), t.tx, req.URL.Host, backend)
+		},
+	}
+	return resp, nil
+}
+
+// tracedBackend returns the key of the attributes of the request: the URL pattern of the
+// backend set by BackendFactory or, if the client is used without it, the host
+func tracedBackend(req *http.Request) string {
+	if pattern, ok := req.Context().Value(backendCtxKey).(string); ok {
+		return backendPath(pattern)
+	}
+	return req.URL.Host
+}
+
+type phaseTimings struct {
+	mu        sync.Mutex
+	start     time.Time
+	starts    map[string]time.Time
+	durations map[string]time.Duration
+	reused    bool
+}
+
+func newPhaseTimings() *phaseTimings {
+	return &phaseTimings{
+		start:     time.Now(),
+		starts:    map[string]time.Time{},
+		durations: map[string]time.Duration{},
+	}
+}
+
+func (p *phaseTimings) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:             func(_ httptrace.DNSStartInfo) { p.begin(phaseDNS) },
+		DNSDone:              func(_ httptrace.DNSDoneInfo) { p.end(phaseDNS) },
+		ConnectStart:         func(_, _ string) { p.begin(phaseConnect) },
+		ConnectDone:          func(_, _ string, _ error) { p.end(phaseConnect) },
+		TLSHandshakeStart:    func() { p.begin(phaseTLS) },
+		TLSHandshakeDone:     func(_ tls.ConnectionState, _ error) { p.end(phaseTLS) },
+		GotConn:              p.gotConn,
+		GotFirstResponseByte: p.gotFirstResponseByte,
+	}
+}
+
+func (p *phaseTimings) begin(phase string) {
+	p.mu.Lock()
+	if _, ok := p.starts[phase]; !ok {
+		p.starts[phase] = time.Now()
+	}
+	p.mu.Unlock()
+}
+
+func (p *phaseTimings) end(phase string) {
+	p.mu.Lock()
+	if start, ok := p.starts[phase]; ok {
+		p.durations[phase] = time.Since(start)
+	}
+	p.mu.Unlock()
+}
+
+func (p *phaseTimings) gotConn(info httptrace.GotConnInfo) {
+	p.mu.Lock()
+	p.reused = info.Reused
+	p.mu.Unlock()
+}
+
+func (p *phaseTimings) gotFirstResponseByte() {
+	p.mu.Lock()
+	p.durations[phaseFirstByte] = time.Since(p.start)
+	p.starts[phaseBodyRead] = time.Now()
+	p.mu.Unlock()
+}
+
+func (p *phaseTimings) bodyRead() {
+	p.end(phaseBodyRead)
+}
+
+func (p *phaseTimings) report(ctx context.Context, tx newrelic.Transaction, host, backend string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for phase, d := range p.durations {
+		addBackendAttribute(ctx, tx, httpAttributePrefix+phase, backend, d.Seconds())
+		recordCustomMetric(tx, httpMetricPrefix+phase+"/"+host, d.Seconds())
+	}
+	addBackendAttribute(ctx, tx, httpConnReusedAttribute, backend, p.reused)
+}
+
+// tracedBody calls done once, when the body is completely read or closed
+type tracedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (t *tracedBody) Read(b []byte) (int, error) {
+	n, err := t.ReadCloser.Read(b)
+	if err == io.EOF {
+		t.once.Do(t.done)
+	}
+	return n, err
+}
+
+func (t *tracedBody) Close() error {
+	err := t.ReadCloser.Close()
+	t.once.Do(t.done)
+	return err
+}
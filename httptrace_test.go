@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHTTPClientFactory_okHTTPTrace(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, `{"status":"ok"}`)
+	}))
+	defer s.Close()
+
+	nrApp := newApp()
+	defer func() { app = nil }()
+	mu := new(sync.Mutex)
+	metrics := map[string]int{}
+	nrApp.recordCustomMetric = func(name string, value float64) error {
+		mu.Lock()
+		metrics[name]++
+		mu.Unlock()
+		return nil
+	}
+	app = &Application{nrApp, Config{InstrumentationRate: 100, HTTPTrace: true}}
+
+	attributes := map[string]interface{}{}
+	txn := newTx()
+	txn.addAttribute = func(key string, value interface{}) error {
+		mu.Lock()
+		attributes[key] = value
+		mu.Unlock()
+		return nil
+	}
+
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	cf := HTTPClientFactory(func(_ context.Context) *http.Client {
+		return &http.Client{Transport: transport}
+	})
+	ctx := context.WithValue(context.Background(), nrCtxKey, txn)
+	host := s.Listener.Addr().String()
+	attribute := func(name string) string { return name + "[" + host + "]" }
+
+	for i, reused := range []bool{false, true} {
+		resp, err := cf(ctx).Get(s.URL)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err.Error())
+			return
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		mu.Lock()
+		if attributes[attribute(httpConnReusedAttribute)] != reused {
+			t.Errorf("%d: unexpected connection reuse: %v", i, attributes)
+		}
+		for _, phase := range []string{phaseFirstByte, phaseBodyRead} {
+			if _, ok := attributes[attribute(httpAttributePrefix+phase)].(float64); !ok {
+				t.Errorf("%d: missing phase %s: %v", i, phase, attributes)
+			}
+		}
+		mu.Unlock()
+	}
+
+	backendCtx := context.WithValue(ctx, backendCtxKey, "users")
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	resp, err := cf(backendCtx).Do(req.WithContext(backendCtx))
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attributes[backendAttribute(httpConnReusedAttribute, "/users")] != true {
+		t.Errorf("unexpected connection reuse of the backend: %v", attributes)
+	}
+	if _, ok := attributes[attribute(httpAttributePrefix+phaseConnect)].(float64); !ok {
+		t.Errorf("missing phase %s: %v", phaseConnect, attributes)
+	}
+	if metrics[httpMetricPrefix+phaseConnect+"/"+host] != 1 {
+		t.Errorf("unexpected metrics: %v", metrics)
+	}
+	if metrics[httpMetricPrefix+phaseFirstByte+"/"+host] != 3 {
+		t.Errorf("unexpected metrics: %v", metrics)
+	}
+}
+
+func TestTracedBody_okDoneOnce(t *testing.T) {
+	calls := 0
+	body := &tracedBody{
+		ReadCloser: ioutil.NopCloser(strings.NewReader("body")),
+		done:       func() { calls++ },
+	}
+	ioutil.ReadAll(body)
+	body.Close()
+
+	if calls != 1 {
+		t.Errorf("unexpected number of calls: %d", calls)
+	}
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// IgnoreConfig defines the requests that should never be instrumented
+type IgnoreConfig struct {
+	// Paths is a list of path prefixes
+	Paths []string `json:"paths"`
+	// PathGlobs is a list of path.Match patterns
+	PathGlobs []string `json:"pathGlobs"`
+	// PathRegexps is a list of regular expressions matched against the path
+	PathRegexps []string `json:"pathRegexps"`
+	// Methods is a list of HTTP methods
+	Methods []string `json:"methods"`
+	// UserAgents is a list of regular expressions matched against the User-Agent header
+	UserAgents []string `json:"userAgents"`
+}
+
+type ignoreRules struct {
+	prefixes   []string
+	globs      []string
+	paths      []*regexp.Regexp
+	methods    map[string]struct{}
+	userAgents []*regexp.Regexp
+}
+
+func newIgnoreRules(cfg IgnoreConfig) (*ignoreRules, error) {
+	rules := &ignoreRules{
+		prefixes: cfg.Paths,
+		globs:    cfg.PathGlobs,
+		methods:  make(map[string]struct{}, len(cfg.Methods)),
+	}
+
+	for _, glob := range cfg.PathGlobs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if rules.paths, err = compileAll(cfg.PathRegexps); err != nil {
+		return nil, err
+	}
+	if rules.userAgents, err = compileAll(cfg.UserAgents); err != nil {
+		return nil, err
+	}
+
+	for _, method := range cfg.Methods {
+		rules.methods[strings.ToUpper(method)] = struct{}{}
+	}
+
+	return rules, nil
+}
+
+func (r *ignoreRules) isEmpty() bool {
+	return len(r.prefixes) == 0 && len(r.globs) == 0 && len(r.paths) == 0 &&
+		len(r.methods) == 0 && len(r.userAgents) == 0
+}
+
+func (r *ignoreRules) match(req *http.Request) bool {
+	if _, ok := r.methods[req.Method]; ok {
+		return true
+	}
+
+	p := req.URL.Path
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	for _, glob := range r.globs {
+		if ok, _ := path.Match(glob, p); ok {
+			return true
+		}
+	}
+	for _, re := range r.paths {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+
+	if len(r.userAgents) == 0 {
+		return false
+	}
+	ua := req.UserAgent()
+	for _, re := range r.userAgents {
+		if re.MatchString(ua) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func compileAll(exprs []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(exprs))
+	for i, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = re
+	}
+	return res, nil
+}
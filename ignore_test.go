@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIgnoreRules_okMatch(t *testing.T) {
+	rules, err := newIgnoreRules(IgnoreConfig{
+		Paths:       []string{"/__health"},
+		PathGlobs:   []string{"/probes/*"},
+		PathRegexps: []string{"^/v[0-9]+/status$"},
+		Methods:     []string{"options"},
+		UserAgents:  []string{"(?i)googlebot", "^kube-probe/"},
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+
+	for _, tc := range []struct {
+		method    string
+		path      string
+		userAgent string
+		expected  bool
+	}{
+		{method: "GET", path: "/__health", expected: true},
+		{method: "GET", path: "/__health/deep", expected: true},
+		{method: "GET", path: "/probes/ready", expected: true},
+		{method: "GET", path: "/probes/ready/now", expected: false},
+		{method: "GET", path: "/v2/status", expected: true},
+		{method: "GET", path: "/v2/status/all", expected: false},
+		{method: "OPTIONS", path: "/users", expected: true},
+		{method: "GET", path: "/users", userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1)", expected: true},
+		{method: "GET", path: "/users", userAgent: "kube-probe/1.10", expected: true},
+		{method: "GET", path: "/users", userAgent: "curl/7.54.0", expected: false},
+		{method: "POST", path: "/users", expected: false},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		req.Header.Set("User-Agent", tc.userAgent)
+		if res := rules.match(req); res != tc.expected {
+			t.Errorf("%s %s (%s): unexpected result. have: %v, want: %v", tc.method, tc.path, tc.userAgent, res, tc.expected)
+		}
+	}
+}
+
+func TestIgnoreRules_okEmpty(t *testing.T) {
+	rules, err := newIgnoreRules(IgnoreConfig{})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if !rules.isEmpty() {
+		t.Error("the rules should be empty")
+	}
+	req, _ := http.NewRequest("GET", "/__health", nil)
+	if rules.match(req) {
+		t.Error("empty rules should not match any request")
+	}
+}
+
+func TestNewIgnoreRules_koWrongPatterns(t *testing.T) {
+	for _, cfg := range []IgnoreConfig{
+		{PathGlobs: []string{"/probes/["}},
+		{PathRegexps: []string{"/v[0-9+/status"}},
+		{UserAgents: []string{"(bot"}},
+	} {
+		if _, err := newIgnoreRules(cfg); err == nil {
+			t.Errorf("it should have errored: %v", cfg)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+	krakendgin "github.com/devopsfaith/krakend/router/gin"
+	"github.com/devopsfaith/krakend/sd"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// ProxySegmentName is the default name of the proxy segments
+	ProxySegmentName = "proxy"
+	// BackendSegmentName is the default name of the backend segments
+	BackendSegmentName = "backend"
+)
+
+// Factories defines the base KrakenD factories to instrument. Since every layer is built on
+// top of the previous one, the backend and the proxy factories are defined as builders, so
+// they receive the instrumented version of the layer below. All the fields are optional
+type Factories struct {
+	// HTTPClientFactory defaults to proxy.NewHTTPClient
+	HTTPClientFactory proxy.HTTPClientFactory
+	// BackendFactory defaults to the KrakenD HTTP proxy with the instrumented response parser
+	// (HTTPResponseParserFactory)
+	BackendFactory func(proxy.HTTPClientFactory) proxy.BackendFactory
+	// ProxyFactory defaults to the KrakenD default proxy stack built with the instrumented
+	// merge, concurrent and request builder middlewares
+	ProxyFactory func(proxy.BackendFactory, logging.Logger) proxy.Factory
+	// HandlerFactory defaults to the KrakenD gin endpoint handler
+	HandlerFactory krakendgin.HandlerFactory
+}
+
+// Instrumented contains the router middleware and the instrumented factories, ready to be
+// used for building the gateway, the logger linking the entries to the transactions and the
+// function for shutting down the NewRelic app
+type Instrumented struct {
+	Logger            logging.Logger
+	Middleware        gin.HandlerFunc
+	HandlerFactory    krakendgin.HandlerFactory
+	ProxyFactory      proxy.Factory
+	BackendFactory    proxy.BackendFactory
+	HTTPClientFactory proxy.HTTPClientFactory
+	Shutdown          func(timeout time.Duration)
+}
+
+// Instrument registers the NewRelic app with the service config and instruments all the
+// layers of the gateway with the default segment names. If the module is not configured,
+// the factories are returned without instrumentation
+func Instrument(cfg config.ServiceConfig, logger logging.Logger, f Factories) Instrumented {
+	if f.HTTPClientFactory == nil {
+		f.HTTPClientFactory = proxy.NewHTTPClient
+	}
+	if f.BackendFactory == nil {
+		f.BackendFactory = httpProxyFactory
+	}
+	if f.ProxyFactory == nil {
+		f.ProxyFactory = defaultProxyFactory
+	}
+	if f.HandlerFactory == nil {
+		f.HandlerFactory = krakendgin.EndpointHandler
+	}
+
+	RegisterService(cfg, logger)
+	if app != nil {
+		logger = moduleLogger
+	}
+
+	mw, err := Middleware()
+	if err != nil && err != errNoApp {
+		logger.Warning("unable to create the NR middleware:", err.Error())
+	}
+
+	clientFactory := HTTPClientFactory(f.HTTPClientFactory)
+	backendFactory := BackendFactory(BackendSegmentName, f.BackendFactory(clientFactory))
+	proxyFactory := ProxyFactory(ProxySegmentName, f.ProxyFactory(backendFactory, logger))
+
+	return Instrumented{
+		Logger:            logger,
+		Middleware:        mw,
+		HandlerFactory:    HandlerFactory(f.HandlerFactory),
+		ProxyFactory:      proxyFactory,
+		BackendFactory:    backendFactory,
+		HTTPClientFactory: clientFactory,
+		Shutdown:          shutdown,
+	}
+}
+
+// httpProxyFactory creates the KrakenD HTTP proxies, decoding and formatting the responses
+// with HTTPResponseParserFactory and exposing the rejected status codes with StatusHandler
+func httpProxyFactory(cf proxy.HTTPClientFactory) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		rp := HTTPResponseParserFactory(proxy.HTTPResponseParserConfig{
+			Decoder:         remote.Decoder,
+			EntityFormatter: proxy.NewEntityFormatter(remote),
+		})
+		return proxy.NewHTTPProxyDetailed(remote, proxy.DefaultHTTPRequestExecutor(cf), StatusHandler(proxy.DefaultHTTPStatusHandler), rp)
+	}
+}
+
+// defaultProxyFactory builds the stack of the KrakenD default proxy factory, balancing the
+// backends over the hosts of their sd.GetSubscriber subscriber, with the instrumented
+// versions of its middlewares
+func defaultProxyFactory(backendFactory proxy.BackendFactory, _ logging.Logger) proxy.Factory {
+	return proxy.FactoryFunc(func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+		switch len(cfg.Backend) {
+		case 0:
+			return nil, proxy.ErrNoBackends
+		case 1:
+			return backendStack(backendFactory, cfg.Backend[0]), nil
+		}
+		backends := make([]proxy.Proxy, len(cfg.Backend))
+		for i, remote := range cfg.Backend {
+			backends[i] = backendStack(backendFactory, remote)
+		}
+		return NewMergeDataMiddleware(cfg)(backends...), nil
+	})
+}
+
+func backendStack(backendFactory proxy.BackendFactory, remote *config.Backend) proxy.Proxy {
+	p := backendFactory(remote)
+	p = proxy.NewRoundRobinLoadBalancedMiddlewareWithSubscriber(sd.GetSubscriber(remote))(p)
+	if remote.ConcurrentCalls > 1 {
+		p = NewConcurrentMiddleware(remote)(p)
+	}
+	return NewRequestBuilderMiddleware(remote)(p)
+}
+
+func shutdown(timeout time.Duration) {
+	stopConfigWatcher()
+	if app == nil {
+		return
+	}
+	app.Shutdown(timeout)
+	shutdownNamedApps(timeout)
+}
@@ -0,0 +1,257 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/encoding"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+	"github.com/devopsfaith/krakend/sd"
+	"github.com/gin-gonic/gin"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestInstrument_okNoConfig(t *testing.T) {
+	app = nil
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte(`{"foo":42}`))
+	}))
+	defer s.Close()
+
+	buff := &bytes.Buffer{}
+	logger, err := logging.NewLogger("DEBUG", buff, "pref")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	instrumented := Instrument(config.ServiceConfig{}, logger, Factories{})
+	if instrumented.Middleware == nil {
+		t.Error("nil middleware")
+		return
+	}
+	instrumented.Shutdown(time.Second)
+
+	w := serveInstrumented(t, instrumented, s.URL)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("unexpected status code: %d", w.Result().StatusCode)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"foo":42`) {
+		t.Errorf("unexpected body: %s", body)
+	}
+	if strings.Contains(buff.String(), "WARNING") {
+		t.Errorf("unexpected log: %s", buff.String())
+	}
+}
+
+func TestInstrument_okNRApp(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte(`{"foo":42}`))
+	}))
+	defer s.Close()
+
+	mu := new(sync.Mutex)
+	segments := 0
+	txns := 0
+	shutdowns := 0
+
+	nrApp := newApp()
+	nrApp.startTransaction = func(name string, w http.ResponseWriter, r *http.Request) newrelic.Transaction {
+		mu.Lock()
+		txns++
+		mu.Unlock()
+		txn := newTx()
+		txn.ResponseWriter = w
+		txn.startSegmentNow = func() newrelic.SegmentStartTime {
+			mu.Lock()
+			segments++
+			mu.Unlock()
+			return newrelic.SegmentStartTime{}
+		}
+		return txn
+	}
+	nrApp.shutdown = func(_ time.Duration) { shutdowns++ }
+	app = &Application{nrApp, Config{InstrumentationRate: 100}}
+	defer func() { app = nil }()
+
+	buff := &bytes.Buffer{}
+	logger, err := logging.NewLogger("DEBUG", buff, "pref")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	instrumented := Instrument(config.ServiceConfig{}, logger, Factories{})
+
+	w := serveInstrumented(t, instrumented, s.URL)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("unexpected status code: %d", w.Result().StatusCode)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"foo":42`) {
+		t.Errorf("unexpected body: %s", body)
+	}
+
+	mu.Lock()
+	if txns != 1 {
+		t.Errorf("unexpected number of transactions: %d", txns)
+	}
+	// the proxy, the backend and the http client
+	if segments < 3 {
+		t.Errorf("unexpected number of segments: %d", segments)
+	}
+	mu.Unlock()
+
+	instrumented.Shutdown(time.Second)
+	if shutdowns != 1 {
+		t.Errorf("unexpected number of shutdowns: %d", shutdowns)
+	}
+}
+
+func serveInstrumented(t *testing.T, instrumented Instrumented, host string) *httptest.ResponseRecorder {
+	endpoint := &config.EndpointConfig{
+		Endpoint: "/my_endpoint",
+		Method:   "GET",
+		Timeout:  time.Second,
+		Backend: []*config.Backend{
+			{
+				Host:       []string{host},
+				URLPattern: "/foo",
+				Decoder:    encoding.JSONDecoder,
+			},
+		},
+	}
+
+	p, err := instrumented.ProxyFactory.New(endpoint)
+	if err != nil {
+		t.Error(err)
+		return httptest.NewRecorder()
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(instrumented.Middleware)
+	router.GET(endpoint.Endpoint, instrumented.HandlerFactory(endpoint, p))
+
+	req, _ := http.NewRequest("GET", "/my_endpoint", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestInstrument_okServiceDiscovery(t *testing.T) {
+	app = nil
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte(`{"discovered":true}`))
+	}))
+	defer s.Close()
+
+	sd.GetRegister().Register("newrelic-test", func(_ *config.Backend) sd.Subscriber {
+		return sd.FixedSubscriber{s.URL}
+	})
+
+	instrumented := Instrument(config.ServiceConfig{}, logging.NoOp, Factories{})
+	p, err := instrumented.ProxyFactory.New(&config.EndpointConfig{
+		Endpoint: "/discovered",
+		Backend: []*config.Backend{
+			{
+				Host:       []string{"http://not-discovered.invalid"},
+				SD:         "newrelic-test",
+				URLPattern: "/foo",
+				Decoder:    encoding.JSONDecoder,
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := p(context.Background(), &proxy.Request{})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if resp.Data["discovered"] != true {
+		t.Errorf("unexpected response: %v", resp.Data)
+	}
+}
+
+func TestInstrument_okPipelineSegments(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"` + strings.Trim(r.URL.Path, "/") + `":42}`))
+	}))
+	defer s.Close()
+
+	mu := new(sync.Mutex)
+	segments := map[string]int{}
+	defer func() {
+		app = nil
+		newSegment = newrelic.StartSegment
+	}()
+	newSegment = func(tx newrelic.Transaction, name string) *newrelic.Segment {
+		mu.Lock()
+		segments[name]++
+		mu.Unlock()
+		return newrelic.StartSegment(tx, name)
+	}
+
+	nrApp := newApp()
+	nrApp.startTransaction = func(name string, w http.ResponseWriter, r *http.Request) newrelic.Transaction {
+		txn := newTx()
+		txn.ResponseWriter = w
+		return txn
+	}
+	app = &Application{nrApp, Config{InstrumentationRate: 100}}
+
+	logger, _ := logging.NewLogger("DEBUG", new(bytes.Buffer), "pref")
+	instrumented := Instrument(config.ServiceConfig{}, logger, Factories{})
+
+	endpoint := &config.EndpointConfig{
+		Endpoint: "/my_endpoint",
+		Method:   "GET",
+		Timeout:  time.Second,
+		Backend: []*config.Backend{
+			{Host: []string{s.URL}, URLPattern: "/foo", Decoder: encoding.JSONDecoder},
+			{Host: []string{s.URL}, URLPattern: "/bar", Decoder: encoding.JSONDecoder},
+		},
+	}
+	p, err := instrumented.ProxyFactory.New(endpoint)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(instrumented.Middleware)
+	router.GET(endpoint.Endpoint, instrumented.HandlerFactory(endpoint, p))
+
+	req, _ := http.NewRequest("GET", "/my_endpoint", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if body := w.Body.String(); !strings.Contains(body, `"foo":42`) || !strings.Contains(body, `"bar":42`) {
+		t.Errorf("unexpected body: %s", body)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for name, expected := range map[string]int{
+		MergeSegmentName:          1,
+		RequestBuilderSegmentName: 2,
+		DecodeSegmentName:         2,
+		FormatSegmentName:         2,
+	} {
+		if segments[name] != expected {
+			t.Errorf("unexpected number of %s segments. have: %d, want: %d", name, segments[name], expected)
+		}
+	}
+}
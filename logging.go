@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/newrelic/go-agent"
+)
+
+const (
+	// LogFormatText appends the linking metadata to the log entries as key=value pairs
+	LogFormatText = "text"
+	// LogFormatJSON logs the entries as JSON objects with the message and the linking metadata
+	LogFormatJSON = "json"
+
+	defaultLogLevel = "INFO"
+)
+
+var logLevels = map[string]int{"DEBUG": 0, "INFO": 1, "WARNING": 2, "ERROR": 3, "CRITICAL": 4, "FATAL": 5}
+
+// LogsConfig defines how the entries logged while a transaction is in the context are linked
+// to it (logs in context). The module logs through a ContextLogger built with it
+type LogsConfig struct {
+	// Format of the linked entries. Defaults to text
+	Format string `json:"format"`
+	// Level is the min level of the json entries, on top of the level of the KrakenD logger.
+	// Defaults to INFO
+	Level string `json:"level"`
+}
+
+func (l LogsConfig) validate() error {
+	if l.Format != "" && l.Format != LogFormatText && l.Format != LogFormatJSON {
+		return fmt.Errorf("unknown log format %s", l.Format)
+	}
+	if _, ok := logLevels[strings.ToUpper(l.Level)]; l.Level != "" && !ok {
+		return fmt.Errorf("unknown log level %s", l.Level)
+	}
+	return nil
+}
+
+// ContextLogger decorates a KrakenD logger so the entries logged while a transaction is in the
+// context are linked to it (logs in context): they get the trace.id, span.id, entity.guid,
+// entity.name and hostname of the transaction. It logs like the wrapped logger otherwise
+type ContextLogger struct {
+	logger logging.Logger
+	format string
+	level  int
+}
+
+// NewContextLogger returns a ContextLogger for the received logger and config
+func NewContextLogger(logger logging.Logger, cfg LogsConfig) ContextLogger {
+	format := cfg.Format
+	if format != LogFormatJSON {
+		format = LogFormatText
+	}
+	level, ok := logLevels[strings.ToUpper(cfg.Level)]
+	if !ok {
+		level = logLevels[defaultLogLevel]
+	}
+	return ContextLogger{logger: logger, format: format, level: level}
+}
+
+// WithContext returns a logger decorated with the linking metadata of the transaction of the
+// context. If there is no transaction, the wrapped logger is returned
+func (c ContextLogger) WithContext(ctx context.Context) logging.Logger {
+	tx, ok := lookupTransaction(ctx)
+	if !ok {
+		return c.wrapped()
+	}
+	return linkedLogger{
+		ContextLogger: c,
+		metadata:      linkingMetadata(tx.GetLinkingMetadata()),
+	}
+}
+
+func (c ContextLogger) Debug(v ...interface{})    { c.wrapped().Debug(v...) }
+func (c ContextLogger) Info(v ...interface{})     { c.wrapped().Info(v...) }
+func (c ContextLogger) Warning(v ...interface{})  { c.wrapped().Warning(v...) }
+func (c ContextLogger) Error(v ...interface{})    { c.wrapped().Error(v...) }
+func (c ContextLogger) Critical(v ...interface{}) { c.wrapped().Critical(v...) }
+func (c ContextLogger) Fatal(v ...interface{})    { c.wrapped().Fatal(v...) }
+
+func (c ContextLogger) wrapped() logging.Logger {
+	if c.logger == nil {
+		return logging.NoOp
+	}
+	return c.logger
+}
+
+// loggerFromContext returns the module logger, linked to the transaction of the context
+func loggerFromContext(ctx context.Context) logging.Logger {
+	if l, ok := moduleLogger.(ContextLogger); ok {
+		return l.WithContext(ctx)
+	}
+	return moduleLogger
+}
+
+type linkedMetadata [][2]string
+
+func linkingMetadata(md newrelic.LinkingMetadata) linkedMetadata {
+	res := linkedMetadata{}
+	for _, kv := range [][2]string{
+		{"trace.id", md.TraceID},
+		{"span.id", md.SpanID},
+		{"entity.guid", md.EntityGUID},
+		{"entity.name", md.EntityName},
+		{"hostname", md.Hostname},
+	} {
+		if kv[1] != "" {
+			res = append(res, kv)
+		}
+	}
+	return res
+}
+
+type linkedLogger struct {
+	ContextLogger
+	metadata linkedMetadata
+}
+
+func (l linkedLogger) Debug(v ...interface{}) {
+	if v, ok := l.entry("DEBUG", v); ok {
+		l.wrapped().Debug(v...)
+	}
+}
+
+func (l linkedLogger) Info(v ...interface{}) {
+	if v, ok := l.entry("INFO", v); ok {
+		l.wrapped().Info(v...)
+	}
+}
+
+func (l linkedLogger) Warning(v ...interface{}) {
+	if v, ok := l.entry("WARNING", v); ok {
+		l.wrapped().Warning(v...)
+	}
+}
+
+func (l linkedLogger) Error(v ...interface{}) {
+	if v, ok := l.entry("ERROR", v); ok {
+		l.wrapped().Error(v...)
+	}
+}
+
+func (l linkedLogger) Critical(v ...interface{}) {
+	if v, ok := l.entry("CRITICAL", v); ok {
+		l.wrapped().Critical(v...)
+	}
+}
+
+// Fatal always delegates to the wrapped logger, so it keeps exiting
+func (l linkedLogger) Fatal(v ...interface{}) {
+	v, _ = l.entry("FATAL", v)
+	l.wrapped().Fatal(v...)
+}
+
+// entry returns the values to log with the wrapped logger: the received ones followed by the
+// linking metadata as key=value pairs or, in the json format, a single JSON object with the
+// message and the linking metadata, as expected by the logs in context of NewRelic. It returns
+// false if the json entry is below the min level
+func (l linkedLogger) entry(level string, v []interface{}) ([]interface{}, bool) {
+	if l.format != LogFormatJSON {
+		return l.decorate(v), true
+	}
+	if logLevels[level] < l.level {
+		return v, false
+	}
+	entry := make(map[string]interface{}, len(l.metadata)+3)
+	entry["timestamp"] = time.Now().UnixNano() / int64(time.Millisecond)
+	entry["log.level"] = level
+	entry["message"] = strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+	for _, kv := range l.metadata {
+		entry[kv[0]] = kv[1]
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return l.decorate(v), true
+	}
+	return []interface{}{string(b)}, true
+}
+
+func (l linkedLogger) decorate(v []interface{}) []interface{} {
+	res := make([]interface{}, len(v), len(v)+len(l.metadata))
+	copy(res, v)
+	for _, kv := range l.metadata {
+		res = append(res, kv[0]+"="+kv[1])
+	}
+	return res
+}
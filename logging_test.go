@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/devopsfaith/krakend/proxy"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestContextLogger_ok(t *testing.T) {
+	txn := newTx()
+	txn.getLinkingMetadata = func() newrelic.LinkingMetadata {
+		return newrelic.LinkingMetadata{
+			TraceID:    "trace1",
+			SpanID:     "span1",
+			EntityGUID: "guid1",
+			EntityName: "gateway",
+		}
+	}
+	ctx := context.WithValue(context.Background(), nrCtxKey, txn)
+
+	buff := new(bytes.Buffer)
+	logger, err := logging.NewLogger("DEBUG", buff, "pref")
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+
+	NewContextLogger(logger, LogsConfig{}).WithContext(ctx).Info("backend", "call")
+	line := buff.String()
+	for _, expected := range []string{"backend", "call", "trace.id=trace1", "span.id=span1", "entity.guid=guid1", "entity.name=gateway"} {
+		if !strings.Contains(line, expected) {
+			t.Errorf("%s not found in the log line: %s", expected, line)
+		}
+	}
+	if strings.Contains(line, "hostname") {
+		t.Errorf("the empty metadata should not be logged: %s", line)
+	}
+
+	buff.Reset()
+	jsonLogger := NewContextLogger(logger, LogsConfig{Format: LogFormatJSON, Level: "WARNING"}).WithContext(ctx)
+	jsonLogger.Error("backend", "failure")
+	jsonLogger.Info("filtered")
+	lines := strings.Split(strings.TrimSuffix(buff.String(), "\n"), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "ERROR") {
+		t.Errorf("unexpected lines: %v", lines)
+		return
+	}
+	entry, err := jsonEntry(lines[0])
+	if err != nil {
+		t.Errorf("unexpected error: %s. line: %s", err.Error(), lines[0])
+		return
+	}
+	if entry["message"] != "backend failure" || entry["log.level"] != "ERROR" || entry["trace.id"] != "trace1" || entry["entity.guid"] != "guid1" {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+	if _, ok := entry["timestamp"].(float64); !ok {
+		t.Errorf("unexpected timestamp: %v", entry)
+	}
+}
+
+func TestContextLogger_okNoTransaction(t *testing.T) {
+	buff := new(bytes.Buffer)
+	logger, err := logging.NewLogger("DEBUG", buff, "pref")
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+
+	if l := NewContextLogger(logger, LogsConfig{Format: LogFormatJSON}).WithContext(context.Background()); l != logger {
+		t.Error("the logger should not be decorated")
+	}
+
+	var zero ContextLogger
+	zero.Info("safe")
+	if l := zero.WithContext(context.Background()); l != logging.NoOp {
+		t.Error("the zero value should not log")
+	}
+}
+
+func TestConfigGetter_koWrongLogs(t *testing.T) {
+	for _, logs := range []map[string]interface{}{
+		{"format": "xml"},
+		{"level": "TRACE"},
+	} {
+		cfg := config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"appName": "test",
+				"license": "123456",
+				"logs":    logs,
+			},
+		}
+		if _, err := ConfigGetter(cfg); err == nil {
+			t.Errorf("it should have errored: %v", logs)
+		}
+	}
+}
+
+func TestInstrument_okContextLogger(t *testing.T) {
+	defer func() {
+		app = nil
+		moduleLogger = logging.NoOp
+		newApplication = newrelic.NewApplication
+	}()
+	newApplication = func(_ newrelic.Config) (newrelic.Application, error) {
+		return newApp(), nil
+	}
+	serviceConfig := config.ServiceConfig{
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"appName": "test",
+				"license": testLicense,
+				"logs":    map[string]interface{}{"format": "json", "level": "DEBUG"},
+			},
+		},
+	}
+	out := new(bytes.Buffer)
+	logger, _ := logging.NewLogger("DEBUG", out, "pref")
+	instrumented := Instrument(serviceConfig, logger, Factories{})
+	defer instrumented.Shutdown(time.Second)
+
+	if _, ok := instrumented.Logger.(ContextLogger); !ok {
+		t.Errorf("unexpected logger: %T", instrumented.Logger)
+	}
+
+	txn := newTx()
+	txn.getLinkingMetadata = func() newrelic.LinkingMetadata {
+		return newrelic.LinkingMetadata{TraceID: "trace1"}
+	}
+	ctx := context.WithValue(context.Background(), nrCtxKey, txn)
+	p := newBackendErrorClassifier(&config.Backend{URLPattern: "/users"}, func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return nil, errors.New("boom")
+	})
+	p(ctx, nil)
+
+	entry, err := jsonEntry(out.String())
+	if err != nil {
+		t.Errorf("unexpected error: %s. log: %s", err.Error(), out.String())
+		return
+	}
+	if entry["trace.id"] != "trace1" || !strings.Contains(entry["message"].(string), "/users") {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+}
+
+// jsonEntry returns the JSON object logged by the KrakenD logger after its prefix
+func jsonEntry(line string) (map[string]interface{}, error) {
+	entry := map[string]interface{}{}
+	start, end := strings.Index(line, "{"), strings.LastIndex(line, "}")
+	if start < 0 || end < start {
+		return entry, errors.New("no JSON object found")
+	}
+	return entry, json.Unmarshal([]byte(line[start:end+1]), &entry)
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/core"
+)
+
+// Labels derived from the service config and the environment
+const (
+	LabelService        = "service"
+	LabelPort           = "port"
+	LabelKrakenDVersion = "krakendVersion"
+	LabelConfigChecksum = "configChecksum"
+	LabelEnvironment    = "environment"
+	LabelRegion         = "region"
+)
+
+const maxAppNames = 3
+
+// defaultLabelsFromEnv are the environment variables of the labels, by label
+var defaultLabelsFromEnv = map[string]string{
+	LabelEnvironment: "KRAKEND_ENVIRONMENT",
+	LabelRegion:      "KRAKEND_REGION",
+}
+
+// serviceMetadata returns a function adding the metadata of the service to the config. The
+// labels get the service name, port, KrakenD version and config checksum, plus the values of
+// the environment variables defined in labelsFromEnv (KRAKEND_ENVIRONMENT and KRAKEND_REGION
+// by default). The host display name is hostname:port and the {label} placeholders of the
+// rollup app names are replaced by the label values. The labels and the host display name
+// defined in the config take precedence
+func serviceMetadata(cfg config.ServiceConfig) func(*Config) {
+	derived := map[string]string{
+		LabelService:        cfg.Name,
+		LabelPort:           strconv.Itoa(cfg.Port),
+		LabelKrakenDVersion: core.KrakendVersion,
+	}
+	if checksum, err := configChecksum(cfg); err == nil {
+		derived[LabelConfigChecksum] = checksum
+	}
+	hostname, _ := os.Hostname()
+
+	return func(conf *Config) {
+		labels := map[string]string{}
+		for k, v := range derived {
+			if v != "" {
+				labels[k] = v
+			}
+		}
+
+		fromEnv := map[string]string{}
+		for k, v := range defaultLabelsFromEnv {
+			fromEnv[k] = v
+		}
+		for k, v := range conf.LabelsFromEnv {
+			fromEnv[k] = v
+		}
+		for label, env := range fromEnv {
+			if v := os.Getenv(env); env != "" && v != "" {
+				labels[label] = v
+			}
+		}
+
+		for k, v := range conf.Labels {
+			labels[k] = v
+		}
+		conf.Labels = labels
+
+		if conf.HostDisplayName == "" && hostname != "" {
+			conf.HostDisplayName = fmt.Sprintf("%s:%d", hostname, cfg.Port)
+		}
+
+		if len(conf.Rollups) == 0 {
+			return
+		}
+		placeholders := make([]string, 0, 2*len(labels))
+		for k, v := range labels {
+			placeholders = append(placeholders, "{"+k+"}", v)
+		}
+		replacer := strings.NewReplacer(placeholders...)
+		names := []string{conf.AppName}
+		for _, rollup := range conf.Rollups {
+			names = append(names, replacer.Replace(rollup))
+		}
+		conf.AppName = strings.Join(names, ";")
+	}
+}
+
+// configChecksum returns a short hash of the service config
+func configChecksum(cfg config.ServiceConfig) (string, error) {
+	return checksum(cfg)
+}
+
+// checksum returns a short hash of the JSON representation of v
+func checksum(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:6]), nil
+}
@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/core"
+	"github.com/devopsfaith/krakend/logging"
+)
+
+func TestServiceMetadata_ok(t *testing.T) {
+	defer setenv("KRAKEND_ENVIRONMENT", "production")()
+	defer setenv("KRAKEND_REGION", "eu-west-1")()
+	defer setenv("DATACENTER", "dc1")()
+
+	cfg := config.ServiceConfig{Name: "gateway", Port: 8080}
+	conf := Config{
+		Rollups:       []string{"{service}-{environment}", "all-gateways"},
+		LabelsFromEnv: map[string]string{"datacenter": "DATACENTER", LabelRegion: ""},
+	}
+	conf.AppName = "gateway-eu"
+	conf.Labels = map[string]string{LabelService: "custom"}
+
+	serviceMetadata(cfg)(&conf)
+
+	checksum, err := configChecksum(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for label, expected := range map[string]string{
+		LabelService:        "custom",
+		LabelPort:           "8080",
+		LabelKrakenDVersion: core.KrakendVersion,
+		LabelConfigChecksum: checksum,
+		LabelEnvironment:    "production",
+		"datacenter":        "dc1",
+	} {
+		if v := conf.Labels[label]; v != expected {
+			t.Errorf("unexpected value of the label %s. have: %s, want: %s", label, v, expected)
+		}
+	}
+	if _, ok := conf.Labels[LabelRegion]; ok {
+		t.Errorf("the region label should be disabled: %v", conf.Labels)
+	}
+
+	if conf.AppName != "gateway-eu;custom-production;all-gateways" {
+		t.Errorf("unexpected app name: %s", conf.AppName)
+	}
+
+	if hostname, _ := os.Hostname(); conf.HostDisplayName != hostname+":8080" {
+		t.Errorf("unexpected host display name: %s", conf.HostDisplayName)
+	}
+}
+
+func TestServiceMetadata_okOverrides(t *testing.T) {
+	conf := Config{}
+	conf.AppName = "gateway"
+	conf.HostDisplayName = "gateway-1"
+
+	serviceMetadata(config.ServiceConfig{Name: "gateway", Port: 8080})(&conf)
+
+	if conf.HostDisplayName != "gateway-1" {
+		t.Errorf("unexpected host display name: %s", conf.HostDisplayName)
+	}
+	if conf.AppName != "gateway" {
+		t.Errorf("unexpected app name: %s", conf.AppName)
+	}
+	if conf.Labels[LabelService] != "gateway" {
+		t.Errorf("unexpected labels: %v", conf.Labels)
+	}
+}
+
+func TestConfigChecksum_ok(t *testing.T) {
+	a, _ := configChecksum(config.ServiceConfig{Name: "gateway", Port: 8080})
+	b, _ := configChecksum(config.ServiceConfig{Name: "gateway", Port: 8080})
+	c, _ := configChecksum(config.ServiceConfig{Name: "gateway", Port: 8081})
+
+	if a != b || a == c || len(a) != 12 {
+		t.Errorf("unexpected checksums: %s %s %s", a, b, c)
+	}
+}
+
+func TestRegisterService_ok(t *testing.T) {
+	defer func() {
+		app = nil
+		moduleLogger = logging.NoOp
+	}()
+	app = nil
+	logger, _ := logging.NewLogger("DEBUG", new(bytes.Buffer), "pref")
+	RegisterService(config.ServiceConfig{
+		Name: "gateway",
+		Port: 8080,
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"appName": "gateway",
+				"license": testLicense,
+				"rollups": []string{"{service}-all"},
+			},
+		},
+	}, logger)
+
+	if app == nil {
+		t.Error("the app has not been registered")
+		return
+	}
+	if app.Config.AppName != "gateway;gateway-all" || app.Config.Labels[LabelPort] != "8080" {
+		t.Errorf("unexpected config: %s %v", app.Config.AppName, app.Config.Labels)
+	}
+}
+
+func TestConfigGetter_koTooManyAppNames(t *testing.T) {
+	cfg := config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"appName": "a;b",
+			"license": "123456",
+			"rollups": []string{"c", "d"},
+		},
+	}
+
+	_, err := ConfigGetter(cfg)
+	if err == nil || !strings.Contains(err.Error(), "app names") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func setenv(key, value string) func() {
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, previous)
+			return
+		}
+		os.Unsetenv(key)
+	}
+}
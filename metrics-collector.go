@@ -5,6 +5,8 @@ import (
 
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/devopsfaith/krakend/config"
 	"github.com/devopsfaith/krakend/logging"
@@ -17,12 +19,44 @@ const Namespace = "github_com/letgoapp/krakend_newrelic"
 var (
 	app            *Application
 	isDebugEnabled bool
+	moduleLogger   = logging.NoOp
+
+	newApplication = newrelic.NewApplication
 )
 
 // Config struct for NewRelic
 type Config struct {
 	newrelic.Config
-	InstrumentationRate int `json:"rate"`
+	InstrumentationRate int                  `json:"rate"`
+	TransactionName     string               `json:"transactionName"`
+	Ignore              IgnoreConfig         `json:"ignore"`
+	StatusCodes         *StatusCodes         `json:"statusCodes"`
+	NoticeErrors        []string             `json:"noticeErrors"`
+	HTTPTrace           bool                 `json:"httpTrace"`
+	RequestID           *RequestIDConfig     `json:"requestID"`
+	Admin               *AdminConfig         `json:"admin"`
+	Reload              *ReloadConfig        `json:"reload"`
+	Retry               *RetryConfig         `json:"retry"`
+	Rollups             []string             `json:"rollups"`
+	LabelsFromEnv       map[string]string    `json:"labelsFromEnv"`
+	Apps                map[string]AppConfig `json:"apps"`
+	Deployment          *DeploymentConfig    `json:"deployment"`
+	Logs                *LogsConfig          `json:"logs"`
+	NetworkConfig
+}
+
+// EndpointConfig struct for the per-endpoint NewRelic settings
+type EndpointConfig struct {
+	TransactionName string       `json:"transactionName"`
+	Label           string       `json:"label"`
+	StatusCodes     *StatusCodes `json:"statusCodes"`
+	ApdexThreshold  string       `json:"apdexT"`
+	App             string       `json:"app"`
+}
+
+// BackendConfig struct for the per-backend NewRelic settings
+type BackendConfig struct {
+	StatusCodes *StatusCodes `json:"statusCodes"`
 }
 
 type Application struct {
@@ -69,28 +103,226 @@ func ConfigGetter(cfg config.ExtraConfig) (Config, error) {
 		return result, err
 	}
 
-	err = json.Unmarshal(marshaledConf, &result)
+	if err = json.Unmarshal(marshaledConf, &result); err != nil {
+		return result, err
+	}
+
+	if _, err = newNamer(result.TransactionName, &config.EndpointConfig{}, ""); err != nil {
+		return result, err
+	}
+
+	if _, err = newIgnoreRules(result.Ignore); err != nil {
+		return result, err
+	}
+
+	if result.Admin != nil && result.Admin.Token == "" {
+		return result, fmt.Errorf("the admin handler requires a token")
+	}
+
+	if result.Reload != nil {
+		if err = result.Reload.validate(); err != nil {
+			return result, err
+		}
+	}
+
+	if names := strings.Count(result.AppName, ";") + 1 + len(result.Rollups); names > maxAppNames {
+		return result, fmt.Errorf("too many app names: %d, the max is %d", names, maxAppNames)
+	}
+
+	if err = result.NetworkConfig.validate(); err != nil {
+		return result, err
+	}
 
+	if result.Retry != nil {
+		if err = result.Retry.validate(); err != nil {
+			return result, err
+		}
+	}
+
+	if result.Deployment != nil {
+		if err = result.Deployment.validate(); err != nil {
+			return result, err
+		}
+	}
+
+	if result.Logs != nil {
+		if err = result.Logs.validate(); err != nil {
+			return result, err
+		}
+	}
+
+	for name, appConf := range result.Apps {
+		if err = appConf.validate(name); err != nil {
+			return result, err
+		}
+	}
+
+	for _, class := range result.NoticeErrors {
+		if class != outcomeError && class != outcomeTimeout && class != outcomeCancelled {
+			return result, fmt.Errorf("unknown error class %s", class)
+		}
+	}
+
+	return result, nil
+}
+
+// EndpointConfigGetter gets the per-endpoint config for NewRelic. Endpoints without
+// a NewRelic section get the zero value. The invalid fields are reset, so the rest of the
+// config still applies, and reported in the error.
+func EndpointConfigGetter(cfg config.ExtraConfig) (EndpointConfig, error) {
+	result := EndpointConfig{}
+	if err := localConfigGetter(cfg, &result); err != nil {
+		return EndpointConfig{}, err
+	}
+
+	var errs []string
+	if result.TransactionName != "" {
+		if _, err := newNamer(result.TransactionName, &config.EndpointConfig{}, ""); err != nil {
+			result.TransactionName = ""
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if result.ApdexThreshold != "" {
+		if threshold, err := time.ParseDuration(result.ApdexThreshold); err != nil || threshold <= 0 {
+			errs = append(errs, fmt.Sprintf("the apdexT must be a positive duration: %s", result.ApdexThreshold))
+			result.ApdexThreshold = ""
+		}
+	}
+
+	if len(errs) > 0 {
+		return result, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return result, nil
+}
+
+// BackendConfigGetter gets the per-backend config for NewRelic. Backends without
+// a NewRelic section get the zero value.
+func BackendConfigGetter(cfg config.ExtraConfig) (BackendConfig, error) {
+	result := BackendConfig{}
+	err := localConfigGetter(cfg, &result)
 	return result, err
 }
 
+func localConfigGetter(cfg config.ExtraConfig, result interface{}) error {
+	v, ok := cfg[Namespace]
+	if !ok {
+		return nil
+	}
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Cannot map config to map string interface")
+	}
+
+	marshaledConf, err := json.Marshal(tmp)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(marshaledConf, result)
+}
+
 // Register registers the NewRelic app
 func Register(cfg config.ExtraConfig, logger logging.Logger) {
+	register(cfg, nil, logger)
+}
+
+// RegisterService registers the NewRelic app like Register, adding the labels, the host
+// display name and the rollup app names derived from the service config and the environment
+func RegisterService(cfg config.ServiceConfig, logger logging.Logger) {
+	register(cfg.ExtraConfig, serviceMetadata(cfg), logger)
+}
+
+func register(cfg config.ExtraConfig, metadata func(*Config), logger logging.Logger) {
 	conf, err := ConfigGetter(cfg)
 	if err != nil {
 		logger.Debug("no config for the NR module:", err.Error())
 		return
 	}
+	logsConf := LogsConfig{}
+	if conf.Logs != nil {
+		logsConf = *conf.Logs
+	}
+	moduleLogger = NewContextLogger(logger, logsConf)
+
+	var watcher *configWatcher
+	if conf.Reload != nil {
+		watcher = newConfigWatcher(*conf.Reload, metadata, logger)
+		if fileConf, err := watcher.load(); err != nil {
+			logger.Error("unable to load the NR config file:", err.Error())
+		} else {
+			conf = fileConf
+		}
+	}
+
+	moduleConf := conf
+	if metadata != nil {
+		metadata(&conf)
+	}
 
 	if isDebugEnabled {
 		conf.Config.Logger = newrelic.NewDebugLogger(os.Stdout)
 	}
 
-	nrApp, err := newrelic.NewApplication(conf.Config)
+	nrApp, err := startApplication(conf)
 	if err != nil {
-		logger.Debug("unable to start the NR module:", err.Error())
-		return
+		if conf.Retry == nil || !isTransient(err) {
+			logger.Error("unable to start the NR module:", err.Error())
+			return
+		}
+		logger.Warning("unable to start the NR module:", err.Error())
+		nrApp = pendingApplication{}
+	}
+
+	var reloadable reloadableApplication
+	if watcher != nil || conf.Retry != nil {
+		reloadable = newReloadableApplication(nrApp)
+		if err != nil {
+			go conf.Retry.retry(conf, reloadable, logger)
+		}
+		nrApp = reloadable
 	}
 
 	app = &Application{nrApp, conf}
+	if watcher != nil {
+		watcher.start(app, reloadable)
+	}
+	replaceNamedApps(conf, logger)
+	endpointRoutes.reset()
+	startSelfMetricsReporter(nrApp)
+
+	if conf.Deployment != nil {
+		revision, err := deploymentRevision(conf, moduleConf)
+		if err != nil {
+			logger.Error("unable to record the NR deployment:", err.Error())
+			return
+		}
+		go recordDeployment(conf, revision, logger)
+	}
+}
+
+// startApplication creates the NewRelic app with the agent config derived from the config
+func startApplication(conf Config) (newrelic.Application, error) {
+	nrConf, err := agentConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	return newApplication(nrConf)
+}
+
+// agentConfig returns the config of the NewRelic agent
+func agentConfig(conf Config) (newrelic.Config, error) {
+	nrConf := conf.Config
+	if conf.StatusCodes != nil {
+		// the module takes care of the status code errors, so the agent must ignore them all
+		nrConf.ErrorCollector.IgnoreStatusCodes = errorStatusCodes()
+	}
+	if conf.NetworkConfig != (NetworkConfig{}) {
+		transport, err := agentTransport(conf.NetworkConfig)
+		if err != nil {
+			return nrConf, err
+		}
+		nrConf.Transport = transport
+	}
+	return nrConf, nil
 }
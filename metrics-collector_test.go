@@ -1,11 +1,12 @@
 package metrics
 
 import (
-	"bytes"
+	"net/http"
 	"testing"
 
 	"github.com/devopsfaith/krakend/config"
 	"github.com/devopsfaith/krakend/logging"
+	"github.com/gin-gonic/gin"
 )
 
 func TestConfigGetter_ok(t *testing.T) {
@@ -86,6 +87,108 @@ func TestConfigGetter_okWithIgnoreStatusCodes(t *testing.T) {
 	}
 }
 
+func TestConfigGetter_koWrongTransactionName(t *testing.T) {
+	cfg := config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"appName":         "test",
+			"license":         "123456",
+			"transactionName": "{method} {path}",
+		},
+	}
+
+	if _, err := ConfigGetter(cfg); err == nil {
+		t.Error("it should have errored")
+	}
+}
+
+func TestConfigGetter_koWrongNoticeErrors(t *testing.T) {
+	cfg := config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"appName":      "test",
+			"license":      "123456",
+			"noticeErrors": []string{"timeout", "slow"},
+		},
+	}
+
+	if _, err := ConfigGetter(cfg); err == nil {
+		t.Error("it should have errored")
+	}
+}
+
+func TestConfigGetter_koAdminWithoutToken(t *testing.T) {
+	cfg := config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"appName": "test",
+			"license": "123456",
+			"admin":   map[string]interface{}{},
+		},
+	}
+
+	if _, err := ConfigGetter(cfg); err == nil {
+		t.Error("it should have errored")
+	}
+}
+
+func TestEndpointConfigGetter_ok(t *testing.T) {
+	res, err := EndpointConfigGetter(config.ExtraConfig{})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if res.TransactionName != "" || res.Label != "" {
+		t.Errorf("unexpected config: %v", res)
+	}
+
+	res, err = EndpointConfigGetter(config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"transactionName": NamingMethodEndpoint,
+			"label":           "users",
+		},
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if res.TransactionName != NamingMethodEndpoint || res.Label != "users" {
+		t.Errorf("unexpected config: %v", res)
+	}
+
+	if _, err = EndpointConfigGetter(config.ExtraConfig{Namespace: true}); err == nil {
+		t.Error("it should have errored")
+	}
+}
+
+func TestEndpointConfigGetter_koWrongTransactionName(t *testing.T) {
+	_, err := EndpointConfigGetter(config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"transactionName": "{method} {path}",
+		},
+	})
+	if err == nil {
+		t.Error("it should have errored")
+	}
+}
+
+func TestEndpointConfigGetter_koWrongField(t *testing.T) {
+	extra := config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"transactionName": NamingMethodEndpoint,
+			"apdexT":          "wrong",
+		},
+	}
+	res, err := EndpointConfigGetter(extra)
+	if err == nil {
+		t.Error("it should have errored")
+	}
+	if res.TransactionName != NamingMethodEndpoint || res.ApdexThreshold != "" {
+		t.Errorf("unexpected config: %v", res)
+	}
+
+	name := transactionNamer(&config.EndpointConfig{Endpoint: "/users", Method: "GET", ExtraConfig: extra}, NamingEndpoint)
+	req, _ := http.NewRequest("GET", "/users", nil)
+	if n := name(&gin.Context{Request: req}); n != "GET /users" {
+		t.Errorf("unexpected name: %s", n)
+	}
+}
+
 func TestConfigGetter_koWrongNamespace(t *testing.T) {
 	cfg := config.ExtraConfig{
 		"WrongNamespace": map[string]interface{}{
@@ -207,11 +310,6 @@ func TestRegister_koUnableToStartNR(t *testing.T) {
 
 func registerNR(t *testing.T, cfg config.ExtraConfig) {
 	app = nil
-	buff := bytes.NewBuffer(make([]byte, 1024))
-	logger, err := logging.NewLogger("DEBUG", buff, "pref")
-	if err != nil {
-		t.Errorf("unexpected error: %s", err.Error())
-		return
-	}
-	Register(cfg, logger)
+	// the module keeps the logger, so it must be safe for the concurrent use of the next tests
+	Register(cfg, logging.NoOp)
 }
@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// NamingEndpoint names the transactions after the endpoint pattern
+	NamingEndpoint = "endpoint"
+	// NamingMethodEndpoint names the transactions after the request method and the endpoint pattern
+	NamingMethodEndpoint = "method_endpoint"
+
+	headerPlaceholderPrefix = "header."
+)
+
+var namingPresets = map[string]string{
+	NamingEndpoint:       "{endpoint}",
+	NamingMethodEndpoint: "{method} {endpoint}",
+}
+
+type namer func(c *gin.Context) string
+
+// newNamer parses the naming template (or preset) and returns a namer for the received endpoint.
+// Supported placeholders are {method}, {endpoint}, {label} and {header.Header-Name}
+func newNamer(template string, cfg *config.EndpointConfig, label string) (namer, error) {
+	if template == "" {
+		template = NamingEndpoint
+	}
+	if preset, ok := namingPresets[template]; ok {
+		template = preset
+	}
+	original := template
+
+	parts := []namer{}
+	for len(template) > 0 {
+		start := strings.IndexByte(template, '{')
+		if start == -1 {
+			parts = append(parts, literalNamer(template))
+			break
+		}
+		if start > 0 {
+			parts = append(parts, literalNamer(template[:start]))
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end == -1 {
+			return nil, fmt.Errorf("unclosed placeholder in the naming template %s", original)
+		}
+		part, err := placeholderNamer(template[start+1:start+end], cfg, label)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+		template = template[start+end+1:]
+	}
+
+	return func(c *gin.Context) string {
+		name := make([]string, len(parts))
+		for i, part := range parts {
+			name[i] = part(c)
+		}
+		return strings.Join(name, "")
+	}, nil
+}
+
+func placeholderNamer(placeholder string, cfg *config.EndpointConfig, label string) (namer, error) {
+	switch {
+	case placeholder == "method":
+		return func(c *gin.Context) string { return c.Request.Method }, nil
+	case placeholder == "endpoint":
+		return literalNamer(cfg.Endpoint), nil
+	case placeholder == "label":
+		return literalNamer(label), nil
+	case strings.HasPrefix(placeholder, headerPlaceholderPrefix) && len(placeholder) > len(headerPlaceholderPrefix):
+		header := placeholder[len(headerPlaceholderPrefix):]
+		return func(c *gin.Context) string { return c.GetHeader(header) }, nil
+	}
+	return nil, fmt.Errorf("unknown placeholder {%s} in the naming template", placeholder)
+}
+
+func literalNamer(s string) namer {
+	return func(_ *gin.Context) string { return s }
+}
+
+// endpointNamer names the transactions of an endpoint, compiling its namer again when the
+// global template is reloaded
+type endpointNamer struct {
+	conf     *config.EndpointConfig
+	compiled *atomic.Value
+}
+
+type compiledNamer struct {
+	template string
+	name     namer
+}
+
+func newEndpointNamer(conf *config.EndpointConfig) endpointNamer {
+	return endpointNamer{conf: conf, compiled: new(atomic.Value)}
+}
+
+func (e endpointNamer) name(c *gin.Context) string {
+	template := currentTransactionName()
+	compiled, _ := e.compiled.Load().(compiledNamer)
+	if compiled.name == nil || compiled.template != template {
+		compiled = compiledNamer{template: template, name: transactionNamer(e.conf, template)}
+		e.compiled.Store(compiled)
+	}
+	return compiled.name(c)
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/gin-gonic/gin"
+)
+
+func TestNewNamer_ok(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		Endpoint: "/users/:id",
+		Method:   "GET",
+	}
+
+	for _, tc := range []struct {
+		template string
+		expected string
+	}{
+		{template: "", expected: "/users/:id"},
+		{template: NamingEndpoint, expected: "/users/:id"},
+		{template: NamingMethodEndpoint, expected: "DELETE /users/:id"},
+		{template: "{label}:{method}", expected: "users-api:DELETE"},
+		{template: "{endpoint} ({header.X-Tenant})", expected: "/users/:id (acme)"},
+		{template: "static", expected: "static"},
+	} {
+		name, err := newNamer(tc.template, cfg, "users-api")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.template, err.Error())
+			continue
+		}
+
+		req, _ := http.NewRequest("DELETE", "/users/42", nil)
+		req.Header.Set("X-Tenant", "acme")
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = req
+
+		if res := name(c); res != tc.expected {
+			t.Errorf("%s: unexpected name. have: %s, want: %s", tc.template, res, tc.expected)
+		}
+	}
+}
+
+func TestNewNamer_koInvalidTemplate(t *testing.T) {
+	cfg := &config.EndpointConfig{Endpoint: "/users/:id"}
+
+	for _, template := range []string{
+		"{method",
+		"{unknown} {endpoint}",
+		"{header.}",
+	} {
+		if _, err := newNamer(template, cfg, ""); err == nil {
+			t.Errorf("%s: it should have errored", template)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Regions of the NewRelic collector
+const (
+	RegionUS      = "us"
+	RegionEU      = "eu"
+	RegionFedRAMP = "fedramp"
+)
+
+var regionCollectorHosts = map[string]string{
+	RegionUS:      "collector.newrelic.com",
+	RegionEU:      "collector.eu01.nr-data.net",
+	RegionFedRAMP: "gov-collector.newrelic.com",
+}
+
+// NetworkConfig defines how the agent connects to NewRelic
+type NetworkConfig struct {
+	// ProxyURL is the URL of the HTTP proxy for the agent requests. The proxy defined in the
+	// environment is used if it is empty
+	ProxyURL string `json:"proxyURL"`
+	// CABundleFile is the path of a PEM file with root CAs to trust besides the system ones
+	CABundleFile string `json:"caBundleFile"`
+	// Region selects the collector of the region: us, eu or fedramp
+	Region string `json:"region"`
+	// CollectorHost overrides the collector host of the region
+	CollectorHost string `json:"collectorHost"`
+}
+
+func (n NetworkConfig) validate() error {
+	if n.ProxyURL != "" {
+		u, err := url.Parse(n.ProxyURL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid proxy URL %s", n.ProxyURL)
+		}
+	}
+	if _, ok := regionCollectorHosts[n.Region]; n.Region != "" && !ok {
+		return fmt.Errorf("unknown region %s", n.Region)
+	}
+	return nil
+}
+
+func (n NetworkConfig) collectorHost() string {
+	if n.CollectorHost != "" {
+		return n.CollectorHost
+	}
+	return regionCollectorHosts[n.Region]
+}
+
+// agentTransport builds the transport of the agent. The agent sends the preconnect request to
+// the collector derived from the license and then it uses the host returned by the collector,
+// so the preconnect requests are the only ones sent to the configured collector
+func agentTransport(cfg NetworkConfig) (http.RoundTripper, error) {
+	// same settings as the http.DefaultTransport
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if cfg.CABundleFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CABundleFile)
+		if err != nil {
+			return nil, transientError{err}
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CABundleFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	if host := cfg.collectorHost(); host != "" {
+		return collectorTransport{next: transport, host: host}, nil
+	}
+	return transport, nil
+}
+
+// collectorTransport sends the preconnect requests of the agent to the configured collector
+type collectorTransport struct {
+	next http.RoundTripper
+	host string
+}
+
+func (c collectorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Query().Get("method") != "preconnect" || req.URL.Host == c.host {
+		return c.next.RoundTrip(req)
+	}
+	// the round trippers must not modify the received request
+	clone := new(http.Request)
+	*clone = *req
+	u := *req.URL
+	u.Host = c.host
+	clone.URL = &u
+	clone.Host = ""
+	return c.next.RoundTrip(clone)
+}
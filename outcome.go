@@ -0,0 +1,173 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/newrelic/go-agent"
+)
+
+const (
+	outcomeOK        = "ok"
+	outcomeError     = "error"
+	outcomeTimeout   = "timeout"
+	outcomeCancelled = "cancelled"
+
+	outcomesCtxKey = "newRelicOutcomes"
+	backendCtxKey  = "newRelicBackend"
+
+	proxyOutcomeAttribute          = "proxy.outcome"
+	backendErrorsAttribute         = "backend.errors"
+	backendTimeoutsAttribute       = "backend.timeouts"
+	backendCancellationsAttribute  = "backend.cancellations"
+	backendDeadlineBudgetAttribute = "backend.deadlineBudget"
+)
+
+// classifyOutcome tells apart the calls that failed, the ones that hit the deadline of the
+// context and the ones cancelled (because the client went away or another concurrent call won)
+func classifyOutcome(ctx context.Context, err error) string {
+	if err == nil {
+		return outcomeOK
+	}
+	if err == context.DeadlineExceeded || ctx.Err() == context.DeadlineExceeded {
+		return outcomeTimeout
+	}
+	if err == context.Canceled || ctx.Err() == context.Canceled {
+		return outcomeCancelled
+	}
+	if t, ok := err.(interface {
+		Timeout() bool
+	}); ok && t.Timeout() {
+		return outcomeTimeout
+	}
+	return outcomeError
+}
+
+// shouldNoticeOutcome returns true if the errors of the outcome class should be reported
+func shouldNoticeOutcome(outcome string) bool {
+	for _, class := range app.Config.NoticeErrors {
+		if class == outcome {
+			return true
+		}
+	}
+	return false
+}
+
+type classifiedError struct {
+	outcome string
+	err     error
+}
+
+func (o classifiedError) Error() string {
+	return o.err.Error()
+}
+
+// ErrorClass groups the errors by their outcome class
+func (o classifiedError) ErrorClass() string {
+	return o.outcome
+}
+
+// ErrorAttributes adds the kind of the error
+func (o classifiedError) ErrorAttributes() map[string]interface{} {
+	return map[string]interface{}{errorKindAttribute: errorKind(o.err)}
+}
+
+// outcomes aggregates the outcomes of the backend calls of a request
+type outcomes struct {
+	mu        sync.Mutex
+	counts    map[string]int
+	budgets   map[string]time.Duration
+	keys      map[string]bool
+	minBudget time.Duration
+	hasBudget bool
+}
+
+func newOutcomes() *outcomes {
+	return &outcomes{counts: map[string]int{}, budgets: map[string]time.Duration{}, keys: map[string]bool{}}
+}
+
+// keyed returns true if the backend gets attributes keyed by backend. Only the first
+// maxKeyedBackends backends of the request get them
+func (o *outcomes) keyed(backend string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.admit(backend)
+}
+
+func (o *outcomes) admit(backend string) bool {
+	if o.keys[backend] {
+		return true
+	}
+	if len(o.keys) >= maxKeyedBackends {
+		return false
+	}
+	o.keys[backend] = true
+	return true
+}
+
+func (o *outcomes) add(outcome string) {
+	o.mu.Lock()
+	o.counts[outcome]++
+	o.mu.Unlock()
+}
+
+func (o *outcomes) budget(backend string, remaining time.Duration) {
+	o.mu.Lock()
+	if backend != "" {
+		if b, ok := o.budgets[backend]; !ok || remaining < b {
+			o.budgets[backend] = remaining
+		}
+	}
+	if !o.hasBudget || remaining < o.minBudget {
+		o.minBudget = remaining
+		o.hasBudget = true
+	}
+	o.mu.Unlock()
+}
+
+func (o *outcomes) report(tx newrelic.Transaction) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	tx.AddAttribute(backendErrorsAttribute, o.counts[outcomeError])
+	tx.AddAttribute(backendTimeoutsAttribute, o.counts[outcomeTimeout])
+	tx.AddAttribute(backendCancellationsAttribute, o.counts[outcomeCancelled])
+	if o.hasBudget {
+		tx.AddAttribute(backendDeadlineBudgetAttribute, o.minBudget.Seconds())
+	}
+	for backend, remaining := range o.budgets {
+		if o.admit(backendPath(backend)) {
+			tx.AddAttribute(backendAttribute(backendDeadlineBudgetAttribute, backend), remaining.Seconds())
+		}
+	}
+}
+
+// recordBackendStart records the remaining deadline budget of the backend call, keyed by the
+// backend set in the context by BackendFactory
+func recordBackendStart(ctx context.Context) {
+	o, ok := ctx.Value(outcomesCtxKey).(*outcomes)
+	if !ok {
+		return
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		backend, _ := ctx.Value(backendCtxKey).(string)
+		o.budget(backend, time.Until(deadline))
+	}
+}
+
+// recordBackendOutcome classifies the result of the backend call, renaming the segment for
+// the unsuccessful ones and reporting the error if its class is configured to be noticed
+func recordBackendOutcome(ctx context.Context, tx newrelic.Transaction, segment *newrelic.Segment, err error) {
+	outcome := classifyOutcome(ctx, err)
+	if o, ok := ctx.Value(outcomesCtxKey).(*outcomes); ok {
+		o.add(outcome)
+	}
+	if outcome == outcomeOK {
+		return
+	}
+	segment.Name += " (" + outcome + ")"
+	if shouldNoticeOutcome(outcome) {
+		noticeError(tx, classifiedError{outcome: outcome, err: err})
+	}
+}
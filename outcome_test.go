@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+func TestClassifyOutcome_ok(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for i, tc := range []struct {
+		ctx      context.Context
+		err      error
+		expected string
+	}{
+		{ctx: context.Background(), expected: outcomeOK},
+		{ctx: context.Background(), err: errors.New("boom"), expected: outcomeError},
+		{ctx: context.Background(), err: context.DeadlineExceeded, expected: outcomeTimeout},
+		{ctx: context.Background(), err: &net.DNSError{IsTimeout: true}, expected: outcomeTimeout},
+		{ctx: expired, err: errors.New("wrapped"), expected: outcomeTimeout},
+		{ctx: context.Background(), err: context.Canceled, expected: outcomeCancelled},
+		{ctx: cancelled, err: errors.New("wrapped"), expected: outcomeCancelled},
+	} {
+		if outcome := classifyOutcome(tc.ctx, tc.err); outcome != tc.expected {
+			t.Errorf("%d: unexpected outcome. have: %s, want: %s", i, outcome, tc.expected)
+		}
+	}
+}
+
+func TestNewProxyMiddleware_okOutcomes(t *testing.T) {
+	nrApp := newApp()
+	defer func() { app = nil }()
+	app = &Application{nrApp, Config{InstrumentationRate: 100, NoticeErrors: []string{outcomeTimeout}}}
+
+	mu := new(sync.Mutex)
+	attributes := map[string]interface{}{}
+	errs := []error{}
+	txn := newTx()
+	txn.addAttribute = func(key string, value interface{}) error {
+		mu.Lock()
+		attributes[key] = value
+		mu.Unlock()
+		return nil
+	}
+	txn.noticeError = func(err error) error {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+		return nil
+	}
+
+	bf := BackendFactory("backend", func(cfg *config.Backend) proxy.Proxy {
+		return func(ctx context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			switch cfg.URLPattern {
+			case "/slow":
+				<-ctx.Done()
+				return nil, ctx.Err()
+			case "/broken":
+				return nil, errors.New("boom")
+			}
+			return &proxy.Response{IsComplete: true}, nil
+		}
+	})
+
+	endpoint := &config.EndpointConfig{Endpoint: "/my_endpoint"}
+	backends := []proxy.Proxy{}
+	for _, pattern := range []string{"/slow", "/broken", "/fast"} {
+		cfg := &config.Backend{URLPattern: pattern}
+		endpoint.Backend = append(endpoint.Backend, cfg)
+		backends = append(backends, bf(cfg))
+	}
+
+	p := NewProxyMiddleware("proxy")(proxy.NewMergeDataMiddleware(endpoint)(backends...))
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), nrCtxKey, txn), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p(ctx, &proxy.Request{}); err == nil {
+		t.Error("it should have errored")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attributes[proxyOutcomeAttribute] != outcomeTimeout {
+		t.Errorf("unexpected proxy outcome: %v", attributes[proxyOutcomeAttribute])
+	}
+	for key, expected := range map[string]int{
+		backendErrorsAttribute:        1,
+		backendTimeoutsAttribute:      1,
+		backendCancellationsAttribute: 0,
+	} {
+		if attributes[key] != expected {
+			t.Errorf("unexpected %s. have: %v, want: %d", key, attributes[key], expected)
+		}
+	}
+	if budget, ok := attributes[backendDeadlineBudgetAttribute].(float64); !ok || budget <= 0 || budget > 0.05 {
+		t.Errorf("unexpected deadline budget: %v", attributes[backendDeadlineBudgetAttribute])
+	}
+	for _, pattern := range []string{"/slow", "/broken", "/fast"} {
+		key := backendAttribute(backendDeadlineBudgetAttribute, pattern)
+		if budget, ok := attributes[key].(float64); !ok || budget <= 0 || budget > 0.05 {
+			t.Errorf("unexpected deadline budget of %s: %v", pattern, attributes[key])
+		}
+	}
+	if len(errs) != 1 {
+		t.Errorf("unexpected errors: %v", errs)
+		return
+	}
+	if class := errs[0].(classifiedError).ErrorClass(); class != outcomeTimeout {
+		t.Errorf("unexpected error class: %s", class)
+	}
+}
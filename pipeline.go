@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+const (
+	// MergeSegmentName is the name of the segment covering the merge of the backend responses
+	MergeSegmentName = "merge"
+	// RequestBuilderSegmentName is the name of the segment covering the backend request generation
+	RequestBuilderSegmentName = "request-builder"
+	// DecodeSegmentName is the name of the segment covering the backend response decoding
+	DecodeSegmentName = "decode"
+	// FormatSegmentName is the name of the segment covering the backend response manipulations
+	// (whitelist, blacklist, group, target and mapping)
+	FormatSegmentName = "format"
+)
+
+// StageMiddleware wraps a KrakenD middleware so its execution is recorded as a segment. Since
+// the segments created by the wrapped proxies are its children, the exclusive time of the
+// stage is the time spent in the middleware itself
+func StageMiddleware(segmentName string, mw proxy.Middleware) proxy.Middleware {
+	if app == nil {
+		return mw
+	}
+	return func(next ...proxy.Proxy) proxy.Proxy {
+		p := mw(next...)
+		return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+			segment := startSegment(transactionFromContext(ctx), segmentName)
+			resp, err := p(ctx, req)
+			segment.End()
+
+			return resp, err
+		}
+	}
+}
+
+// NewMergeDataMiddleware returns an instrumented version of the KrakenD merge data middleware
+func NewMergeDataMiddleware(endpointConfig *config.EndpointConfig) proxy.Middleware {
+	return StageMiddleware(MergeSegmentName, proxy.NewMergeDataMiddleware(endpointConfig))
+}
+
+// NewRequestBuilderMiddleware returns an instrumented version of the KrakenD request builder middleware
+func NewRequestBuilderMiddleware(remote *config.Backend) proxy.Middleware {
+	return StageMiddleware(RequestBuilderSegmentName, proxy.NewRequestBuilderMiddleware(remote))
+}
+
+// HTTPResponseParserFactory returns a response parser equivalent to the KrakenD default one,
+// recording the decoding and the formatting of the response as separated segments
+func HTTPResponseParserFactory(cfg proxy.HTTPResponseParserConfig) proxy.HTTPResponseParser {
+	if app == nil {
+		return proxy.DefaultHTTPResponseParserFactory(cfg)
+	}
+	return func(ctx context.Context, resp *http.Response) (*proxy.Response, error) {
+		defer resp.Body.Close()
+		tx := transactionFromContext(ctx)
+
+		var data map[string]interface{}
+		segment := startSegment(tx, DecodeSegmentName)
+		err := cfg.Decoder(resp.Body, &data)
+		segment.End()
+		if err != nil {
+			return nil, err
+		}
+
+		newResponse := proxy.Response{Data: data, IsComplete: true}
+		segment = startSegment(tx, FormatSegmentName)
+		newResponse = cfg.EntityFormatter.Format(newResponse)
+		segment.End()
+
+		return &newResponse, nil
+	}
+}
@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/encoding"
+	"github.com/devopsfaith/krakend/proxy"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestStageMiddleware_ok(t *testing.T) {
+	nrApp := newApp()
+	defer func() { app = nil }()
+	app = &Application{nrApp, Config{InstrumentationRate: 100}}
+
+	totalCalls := 0
+	txn := newTx()
+	txn.startSegmentNow = func() newrelic.SegmentStartTime {
+		totalCalls++
+		return newrelic.SegmentStartTime{}
+	}
+
+	backend := func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{Data: map[string]interface{}{"a": 1}, IsComplete: true}, nil
+	}
+
+	p := NewMergeDataMiddleware(&config.EndpointConfig{
+		Endpoint: "/my_endpoint",
+		Backend:  []*config.Backend{{}, {}},
+	})(backend, backend)
+
+	resp, err := p(context.WithValue(context.Background(), nrCtxKey, txn), &proxy.Request{})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if resp.Data["a"] != 1 {
+		t.Errorf("unexpected response: %v", resp)
+	}
+
+	if totalCalls != 1 {
+		t.Errorf("wrong number of segments, got: %d, wanted 1", totalCalls)
+	}
+}
+
+func TestStageMiddleware_okAppNil(t *testing.T) {
+	app = nil
+
+	totalCalls := 0
+	mw := func(next ...proxy.Proxy) proxy.Proxy {
+		totalCalls++
+		return next[0]
+	}
+
+	StageMiddleware("segm", mw)(proxy.NoopProxy)
+	if totalCalls != 1 {
+		t.Errorf("the middleware should have been called once, got: %d", totalCalls)
+	}
+}
+
+func TestHTTPResponseParserFactory_ok(t *testing.T) {
+	nrApp := newApp()
+	defer func() { app = nil }()
+	app = &Application{nrApp, Config{InstrumentationRate: 100}}
+
+	totalCalls := 0
+	txn := newTx()
+	txn.startSegmentNow = func() newrelic.SegmentStartTime {
+		totalCalls++
+		return newrelic.SegmentStartTime{}
+	}
+
+	formatted := 0
+	parser := HTTPResponseParserFactory(proxy.HTTPResponseParserConfig{
+		Decoder:         encoding.JSONDecoder,
+		EntityFormatter: formatter(func(r proxy.Response) proxy.Response { formatted++; return r }),
+	})
+
+	resp, err := parser(context.WithValue(context.Background(), nrCtxKey, txn), &http.Response{
+		Body: ioutil.NopCloser(bytes.NewBufferString(`{"a":"b"}`)),
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if resp.Data["a"] != "b" || !resp.IsComplete {
+		t.Errorf("unexpected response: %v", resp)
+	}
+	if formatted != 1 {
+		t.Errorf("unexpected number of calls to the formatter: %d", formatted)
+	}
+	if totalCalls != 2 {
+		t.Errorf("wrong number of segments, got: %d, wanted 2", totalCalls)
+	}
+
+	if _, err := parser(context.WithValue(context.Background(), nrCtxKey, txn), &http.Response{
+		Body: ioutil.NopCloser(bytes.NewBufferString(`{"a":`)),
+	}); err == nil {
+		t.Error("it should have errored")
+	}
+	if formatted != 1 {
+		t.Errorf("unexpected number of calls to the formatter: %d", formatted)
+	}
+}
+
+type formatter func(proxy.Response) proxy.Response
+
+func (f formatter) Format(r proxy.Response) proxy.Response { return f(r) }
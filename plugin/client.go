@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	metrics "github.com/devopsfaith/krakend-newrelic"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+// RegisterClients registers the client executing the requests to the backends with the
+// instrumented http client of the module
+func (r registerer) RegisterClients(f func(
+	name string,
+	handler func(context.Context, map[string]interface{}) (http.Handler, error),
+)) {
+	f(string(r), r.registerClients)
+}
+
+func (r registerer) registerClients(_ context.Context, _ map[string]interface{}) (http.Handler, error) {
+	clientFactory := metrics.HTTPClientFactory(proxy.NewHTTPClient)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		resp, err := clientFactory(req.Context()).Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer resp.Body.Close()
+
+		for k, vs := range resp.Header {
+			for _, v := range vs {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegisterClients_ok(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Backend", "foo")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte(`{"foo":42}`))
+	}))
+	defer s.Close()
+
+	var registered func(context.Context, map[string]interface{}) (http.Handler, error)
+	ClientRegisterer.RegisterClients(func(name string, handler func(context.Context, map[string]interface{}) (http.Handler, error)) {
+		if name != pluginName {
+			t.Errorf("unexpected name: %s", name)
+		}
+		registered = handler
+	})
+	if registered == nil {
+		t.Error("no client registered")
+		return
+	}
+
+	client, err := registered(context.Background(), map[string]interface{}{})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	w := httptest.NewRecorder()
+	client.ServeHTTP(w, req)
+
+	if w.Result().StatusCode != http.StatusTeapot {
+		t.Errorf("unexpected status code: %d", w.Result().StatusCode)
+	}
+	if w.Result().Header.Get("X-Backend") != "foo" {
+		t.Errorf("unexpected headers: %v", w.Result().Header)
+	}
+	if w.Body.String() != `{"foo":42}` {
+		t.Errorf("unexpected body: %s", w.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "http://127.0.0.1:1", nil)
+	w = httptest.NewRecorder()
+	client.ServeHTTP(w, req)
+
+	if w.Result().StatusCode != http.StatusInternalServerError {
+		t.Errorf("unexpected status code: %d", w.Result().StatusCode)
+	}
+}
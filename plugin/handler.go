@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	metrics "github.com/devopsfaith/krakend-newrelic"
+	"github.com/devopsfaith/krakend/config"
+)
+
+// RegisterHandlers registers the handler wrapping the router of the gateway with the
+// NewRelic instrumentation
+func (r registerer) RegisterHandlers(f func(
+	name string,
+	handler func(context.Context, map[string]interface{}, http.Handler) (http.Handler, error),
+)) {
+	f(string(r), r.registerHandlers)
+}
+
+func (r registerer) registerHandlers(_ context.Context, extra map[string]interface{}, h http.Handler) (http.Handler, error) {
+	metrics.Register(config.ExtraConfig(extra), logger)
+
+	handler, err := metrics.NewHTTPHandler(h)
+	if err != nil {
+		logger.Warning("the NR instrumentation is disabled:", err.Error())
+		return h, nil
+	}
+	return handler, nil
+}
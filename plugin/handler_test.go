@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	metrics "github.com/devopsfaith/krakend-newrelic"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestRegisterHandlers_ok(t *testing.T) {
+	handler := registeredHandler(t)
+	if handler == nil {
+		return
+	}
+
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(newrelic.Transaction); !ok {
+			t.Error("the request is not instrumented")
+		}
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	h, err := handler(context.Background(), map[string]interface{}{
+		metrics.Namespace: map[string]interface{}{
+			"appName": "test",
+			"license": "0123456789012345678901234567890123456789",
+			"rate":    100,
+		},
+	}, inner)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+
+	req, _ := http.NewRequest("GET", "/my_endpoint", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Result().StatusCode != http.StatusTeapot {
+		t.Errorf("unexpected status code: %d", w.Result().StatusCode)
+	}
+}
+
+func TestRegisterHandlers_okNoConfig(t *testing.T) {
+	handler := registeredHandler(t)
+	if handler == nil {
+		return
+	}
+
+	inner := http.NotFoundHandler()
+	h, err := handler(context.Background(), map[string]interface{}{}, inner)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+
+	req, _ := http.NewRequest("GET", "/my_endpoint", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status code: %d", w.Result().StatusCode)
+	}
+}
+
+type handlerFactory func(context.Context, map[string]interface{}, http.Handler) (http.Handler, error)
+
+func registeredHandler(t *testing.T) handlerFactory {
+	var registered handlerFactory
+	HandlerRegisterer.RegisterHandlers(func(name string, handler func(context.Context, map[string]interface{}, http.Handler) (http.Handler, error)) {
+		if name != pluginName {
+			t.Errorf("unexpected name: %s", name)
+		}
+		registered = handler
+	})
+	if registered == nil {
+		t.Error("no handler registered")
+	}
+	return registered
+}
@@ -0,0 +1,29 @@
+// Package main is the KrakenD plugin of the NewRelic module. Build it with
+//
+//	go build -buildmode=plugin -o krakend-newrelic.so ./plugin
+//
+// and enable the handler plugin named "krakend-newrelic" in the service extra_config, next to
+// the config of the module under its namespace. The backends enabling the client plugin with
+// the same name get their requests instrumented with the transaction of the handler.
+package main
+
+import (
+	"os"
+
+	"github.com/devopsfaith/krakend/logging"
+)
+
+// pluginName is the name of the handler and the client registered by the plugin
+const pluginName = "krakend-newrelic"
+
+// HandlerRegisterer is the symbol looked up by the KrakenD handler plugin loader
+var HandlerRegisterer = registerer(pluginName)
+
+// ClientRegisterer is the symbol looked up by the KrakenD client plugin loader
+var ClientRegisterer = registerer(pluginName)
+
+type registerer string
+
+var logger, _ = logging.NewLogger("WARNING", os.Stdout, "[NEWRELIC PLUGIN]")
+
+func main() {}
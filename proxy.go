@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"context"
+	"net/http"
 
 	"github.com/devopsfaith/krakend/config"
 	"github.com/devopsfaith/krakend/proxy"
@@ -10,7 +11,8 @@ import (
 
 const nrCtxKey = "newRelicTransaction"
 
-// ProxyFactory creates an instrumented proxy factory
+// ProxyFactory creates an instrumented proxy factory. Endpoints using the sequential proxy
+// also get a segment per step when their backends are created with BackendFactory
 func ProxyFactory(segmentName string, next proxy.Factory) proxy.FactoryFunc {
 	if app == nil {
 		return next.New
@@ -20,11 +22,16 @@ func ProxyFactory(segmentName string, next proxy.Factory) proxy.FactoryFunc {
 		if err != nil {
 			return proxy.NoopProxy, err
 		}
-		return NewProxyMiddleware(segmentName)(next), nil
+		p := NewProxyMiddleware(segmentName)(next)
+		if steps, ok := sequentialSteps(cfg); ok {
+			p = newSequentialProxy(steps, p)
+		}
+		return p, nil
 	})
 }
 
-// NewProxyMiddleware adds NewRelic segmentation
+// NewProxyMiddleware adds NewRelic segmentation. The transaction gets the outcome of the
+// proxy along with the aggregated outcomes and the smallest deadline budget of the backend calls
 func NewProxyMiddleware(segmentName string) proxy.Middleware {
 	if app == nil {
 		return proxy.EmptyMiddleware
@@ -37,16 +44,45 @@ func NewProxyMiddleware(segmentName string) proxy.Middleware {
 			panic(proxy.ErrNotEnoughProxies)
 		}
 		return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
-			tx, ok := ctx.Value(nrCtxKey).(newrelic.Transaction)
+			tx, ok := lookupTransaction(ctx)
 			if !ok {
+				missingTransaction(ctx.Value(skippedCtxKey))
 				return next[0](ctx, req)
 			}
 
-			segment := newrelic.StartSegment(tx, segmentName)
-			resp, err := next[0](ctx, req)
+			o := newOutcomes()
+			segment := startSegment(tx, segmentName)
+			resp, err := next[0](context.WithValue(ctx, outcomesCtxKey, o), req)
 			segment.End()
 
+			tx.AddAttribute(proxyOutcomeAttribute, classifyOutcome(ctx, err))
+			o.report(tx)
+
 			return resp, err
 		}
 	}
 }
+
+func transactionFromContext(ctx context.Context) newrelic.Transaction {
+	tx, _ := lookupTransaction(ctx)
+	return tx
+}
+
+// lookupTransaction returns the transaction of the context
+func lookupTransaction(ctx context.Context) (newrelic.Transaction, bool) {
+	tx, ok := contextValue(ctx, nrCtxKey).(newrelic.Transaction)
+	return tx, ok
+}
+
+// contextValue returns the value of the key in the context. The gin context only exposes its
+// own keys, so the values added to the context of the request (like the transactions started
+// by NewHTTPHandler) are looked up in the request held by the gin context
+func contextValue(ctx context.Context, key string) interface{} {
+	if v := ctx.Value(key); v != nil {
+		return v
+	}
+	if r, ok := ctx.Value(0).(*http.Request); ok && r != nil {
+		return r.Context().Value(key)
+	}
+	return nil
+}
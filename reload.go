@@ -0,0 +1,324 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/newrelic/go-agent"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultReloadInterval = 10 * time.Second
+	reloadShutdownTimeout = 10 * time.Second
+)
+
+var (
+	stopWatcher   = func() {}
+	stopWatcherMu = new(sync.Mutex)
+
+	reloadedConfig = new(atomic.Value)
+)
+
+// ReloadConfig enables the hot reload of the config of the module from a file. The file
+// replaces the config of the module when it is registered and it is watched for changes
+type ReloadConfig struct {
+	// File is the path of the file with the config of the module, with the same content as its
+	// section in the service config. The files with the .yaml or .yml extension are parsed as
+	// YAML and the rest as JSON
+	File string `json:"file"`
+	// Interval is the time between the checks of the file. Defaults to 10s
+	Interval string `json:"interval"`
+}
+
+func (r ReloadConfig) validate() error {
+	if r.File == "" {
+		return fmt.Errorf("the reload option requires a file")
+	}
+	if r.Interval == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(r.Interval); err != nil || d <= 0 {
+		return fmt.Errorf("invalid reload interval %s", r.Interval)
+	}
+	return nil
+}
+
+func (r ReloadConfig) interval() time.Duration {
+	if d, err := time.ParseDuration(r.Interval); err == nil && d > 0 {
+		return d
+	}
+	return defaultReloadInterval
+}
+
+// publishedConfig is the effective config of the app, with the options reloaded from the file
+type publishedConfig struct {
+	app  *Application
+	conf Config
+}
+
+// currentConfig returns the effective config of the module: the config of the app with the
+// options reloaded from the config file
+func currentConfig() Config {
+	if p, ok := reloadedConfig.Load().(*publishedConfig); ok && p.app == app {
+		return p.conf
+	}
+	return app.Config
+}
+
+// configWatcher polls the config file and applies its changes. The sampling rate, the ignore
+// rules and the global naming template are updated in place, while the changes of the agent
+// config (like the license or the app name) replace the NewRelic application, shutting down
+// the previous one. The rest of the options keep their values of the startup. The applied
+// options are published in the effective config of the app. Invalid configs are rejected
+// and logged, keeping the previous one
+type configWatcher struct {
+	cfg      ReloadConfig
+	metadata func(*Config)
+	logger   logging.Logger
+	owner    *Application
+	app      reloadableApplication
+	current  Config
+	modTime  time.Time
+	size     int64
+	content  []byte
+}
+
+func newConfigWatcher(cfg ReloadConfig, metadata func(*Config), logger logging.Logger) *configWatcher {
+	return &configWatcher{cfg: cfg, metadata: metadata, logger: logger}
+}
+
+// load reads and parses the config file, without the metadata of the service
+func (w *configWatcher) load() (Config, error) {
+	info, err := os.Stat(w.cfg.File)
+	if err != nil {
+		return Config{}, err
+	}
+	content, err := ioutil.ReadFile(w.cfg.File)
+	if err != nil {
+		return Config{}, err
+	}
+	w.modTime = info.ModTime()
+	w.size = info.Size()
+	w.content = content
+
+	conf, err := parseConfigFile(w.cfg.File, content)
+	if err != nil {
+		return conf, err
+	}
+	conf.Reload = &w.cfg
+	return conf, nil
+}
+
+// start watches the file of the app in a goroutine, stopping the previous watcher if any
+func (w *configWatcher) start(owner *Application, nrApp reloadableApplication) {
+	w.owner = owner
+	w.app = nrApp
+	w.current = owner.Config
+	done := make(chan struct{})
+
+	stopWatcherMu.Lock()
+	stopWatcher()
+	once := new(sync.Once)
+	stopWatcher = func() { once.Do(func() { close(done) }) }
+	stopWatcherMu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(w.cfg.interval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				w.check()
+			}
+		}
+	}()
+}
+
+func (w *configWatcher) check() {
+	info, err := os.Stat(w.cfg.File)
+	if err != nil || (info.ModTime().Equal(w.modTime) && info.Size() == w.size) {
+		return
+	}
+	previous := w.content
+	conf, err := w.load()
+	if err != nil {
+		w.logger.Error("invalid NR config file, keeping the previous config:", err.Error())
+		return
+	}
+	if bytes.Equal(previous, w.content) {
+		return
+	}
+	if w.metadata != nil {
+		w.metadata(&conf)
+	}
+	if isDebugEnabled {
+		conf.Config.Logger = newrelic.NewDebugLogger(os.Stdout)
+	}
+	if err := w.apply(conf); err != nil {
+		w.logger.Error("unable to apply the NR config file, keeping the previous config:", err.Error())
+		return
+	}
+	w.logger.Info("NR config reloaded from", w.cfg.File)
+}
+
+func (w *configWatcher) apply(conf Config) error {
+	rules, err := newIgnoreRules(conf.Ignore)
+	if err != nil {
+		return err
+	}
+
+	if agentConfigChanged(w.current, conf) {
+		nrApp, err := startApplication(conf)
+		if err != nil {
+			return err
+		}
+		w.app.swap(nrApp).Shutdown(reloadShutdownTimeout)
+	}
+
+	reloadSettings(conf, rules)
+	w.current = conf
+	w.publish(conf)
+	return nil
+}
+
+// publish updates the effective config of the app with the options applied by the reload
+func (w *configWatcher) publish(conf Config) {
+	if w.owner == nil {
+		return
+	}
+	effective := w.owner.Config
+	if p, ok := reloadedConfig.Load().(*publishedConfig); ok && p.app == w.owner {
+		effective = p.conf
+	}
+	effective.Config = conf.Config
+	effective.NetworkConfig = conf.NetworkConfig
+	effective.InstrumentationRate = conf.InstrumentationRate
+	effective.Ignore = conf.Ignore
+	effective.TransactionName = conf.TransactionName
+	reloadedConfig.Store(&publishedConfig{app: w.owner, conf: effective})
+}
+
+func agentConfigChanged(previous, next Config) bool {
+	a, b := previous.Config, next.Config
+	a.Logger, b.Logger = nil, nil
+	a.Transport, b.Transport = nil, nil
+	return !reflect.DeepEqual(a, b) ||
+		(previous.StatusCodes == nil) != (next.StatusCodes == nil) ||
+		previous.NetworkConfig != next.NetworkConfig
+}
+
+// stopConfigWatcher stops watching the config file
+func stopConfigWatcher() {
+	stopWatcherMu.Lock()
+	stopWatcher()
+	stopWatcherMu.Unlock()
+}
+
+func parseConfigFile(path string, content []byte) (Config, error) {
+	var raw interface{}
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &raw)
+		raw = normalizeYAML(raw)
+	default:
+		err = json.Unmarshal(content, &raw)
+	}
+	if err != nil {
+		return Config{}, err
+	}
+	return ConfigGetter(config.ExtraConfig{Namespace: raw})
+}
+
+// normalizeYAML converts the maps decoded from YAML so they can be encoded as JSON
+func normalizeYAML(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[fmt.Sprint(k)] = normalizeYAML(v)
+		}
+		return m
+	case []interface{}:
+		for i := range t {
+			t[i] = normalizeYAML(t[i])
+		}
+	}
+	return v
+}
+
+type applicationRef struct {
+	newrelic.Application
+}
+
+// reloadableApplication delegates to the current NewRelic application, so it can be replaced
+// while it is in use
+type reloadableApplication struct {
+	current *atomic.Value
+	mu      *sync.Mutex
+}
+
+func newReloadableApplication(nrApp newrelic.Application) reloadableApplication {
+	r := reloadableApplication{current: new(atomic.Value), mu: new(sync.Mutex)}
+	r.current.Store(applicationRef{nrApp})
+	return r
+}
+
+func (r reloadableApplication) load() newrelic.Application {
+	return r.current.Load().(applicationRef).Application
+}
+
+// swap replaces the current application, returning the previous one
+func (r reloadableApplication) swap(nrApp newrelic.Application) newrelic.Application {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	previous := r.load()
+	r.current.Store(applicationRef{nrApp})
+	return previous
+}
+
+// replacePending replaces the current application only if it is still pending
+func (r reloadableApplication) replacePending(nrApp newrelic.Application) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.load().(pendingApplication); !ok {
+		return false
+	}
+	r.current.Store(applicationRef{nrApp})
+	return true
+}
+
+func (r reloadableApplication) StartTransaction(name string, w http.ResponseWriter, req *http.Request) newrelic.Transaction {
+	return r.load().StartTransaction(name, w, req)
+}
+
+func (r reloadableApplication) RecordCustomEvent(eventType string, params map[string]interface{}) error {
+	return r.load().RecordCustomEvent(eventType, params)
+}
+
+func (r reloadableApplication) RecordCustomMetric(name string, value float64) error {
+	return r.load().RecordCustomMetric(name, value)
+}
+
+func (r reloadableApplication) WaitForConnection(timeout time.Duration) error {
+	return r.load().WaitForConnection(timeout)
+}
+
+func (r reloadableApplication) Shutdown(timeout time.Duration) {
+	r.load().Shutdown(timeout)
+}
@@ -0,0 +1,258 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+const testLicense = "0123456789012345678901234567890123456789"
+
+func TestParseConfigFile_ok(t *testing.T) {
+	for name, content := range map[string]string{
+		"newrelic.json": `{"appName":"test","license":"123456","rate":42,"ignore":{"paths":["/__health"]}}`,
+		"newrelic.yaml": "appName: test\nlicense: \"123456\"\nrate: 42\nignore:\n  paths:\n    - /__health\n",
+		"newrelic.yml":  "appName: test\nlicense: \"123456\"\nrate: 42\nignore:\n  paths: [/__health]\n",
+	} {
+		conf, err := parseConfigFile(name, []byte(content))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err.Error())
+			continue
+		}
+		if conf.AppName != "test" || conf.InstrumentationRate != 42 || len(conf.Ignore.Paths) != 1 {
+			t.Errorf("%s: unexpected config: %+v", name, conf)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"newrelic.json": `{"appName":"test"`,
+		"newrelic.yaml": "appName: test\nrate: 42\n",
+		"other.json":    `{"appName":"test","license":"123456","transactionName":"{unknown}"}`,
+	} {
+		if _, err := parseConfigFile(name, []byte(content)); err == nil {
+			t.Errorf("%s: it should have errored", name)
+		}
+	}
+}
+
+func TestConfigGetter_koWrongReload(t *testing.T) {
+	for _, reload := range []map[string]interface{}{
+		{},
+		{"file": "newrelic.json", "interval": "never"},
+		{"file": "newrelic.json", "interval": "-1s"},
+	} {
+		cfg := config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"appName": "test",
+				"license": "123456",
+				"reload":  reload,
+			},
+		}
+		if _, err := ConfigGetter(cfg); err == nil {
+			t.Errorf("%v: it should have errored", reload)
+		}
+	}
+}
+
+func TestConfigWatcher_ok(t *testing.T) {
+	defer func() { app = nil }()
+	dir, err := ioutil.TempDir("", "krakend-newrelic")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "newrelic.json")
+	writeConfigFile(t, file, `{"appName":"test","license":"`+testLicense+`","rate":100}`)
+
+	buff := &bytes.Buffer{}
+	logger, _ := logging.NewLogger("DEBUG", buff, "pref")
+
+	shutdowns := 0
+	nrApp := newApp()
+	nrApp.shutdown = func(_ time.Duration) { shutdowns++ }
+	reloadable := newReloadableApplication(nrApp)
+
+	w := newConfigWatcher(ReloadConfig{File: file}, nil, logger)
+	conf, err := w.load()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	app = &Application{reloadable, conf}
+	if _, err := Middleware(); err != nil {
+		t.Error(err)
+		return
+	}
+	w.owner = app
+	w.app = reloadable
+	w.current = conf
+
+	writeConfigFile(t, file, `{"appName":"test","license":"`+testLicense+`","rate":10,"transactionName":"method_endpoint","ignore":{"paths":["/__health"]}}`)
+	w.check()
+
+	s := currentSettings()
+	if s.Rate != 10 || s.transactionName != NamingMethodEndpoint {
+		t.Errorf("unexpected settings: %+v", s)
+	}
+	req, _ := http.NewRequest("GET", "/__health", nil)
+	if !s.rules.match(req) {
+		t.Error("the ignore rules have not been reloaded")
+	}
+	if _, ok := reloadable.load().(sampleApplication); shutdowns != 0 || !ok {
+		t.Error("the app should not be replaced")
+	}
+	if cfg := currentAdminStatus().Config; cfg.InstrumentationRate != 10 || cfg.TransactionName != NamingMethodEndpoint || len(cfg.Ignore.Paths) != 1 {
+		t.Errorf("the reloaded config has not been published: %+v", cfg)
+	}
+
+	writeConfigFile(t, file, `{"appName":"test","license":"`+testLicense+`","rate":"wrong"}`)
+	w.check()
+	if !strings.Contains(buff.String(), "ERROR") {
+		t.Errorf("the error has not been logged: %s", buff.String())
+	}
+	if s := currentSettings(); s.Rate != 10 {
+		t.Errorf("unexpected settings: %+v", s)
+	}
+
+	writeConfigFile(t, file, `{"appName":"renamed","license":"`+testLicense+`","rate":20}`)
+	w.check()
+	if shutdowns != 1 {
+		t.Errorf("unexpected number of shutdowns: %d", shutdowns)
+	}
+	if _, ok := reloadable.load().(sampleApplication); ok {
+		t.Error("the app has not been replaced")
+	}
+	if s := currentSettings(); s.Rate != 20 || s.rules.match(req) {
+		t.Errorf("unexpected settings: %+v", s)
+	}
+	if cfg := currentConfig(); cfg.AppName != "renamed" || cfg.InstrumentationRate != 20 {
+		t.Errorf("the reloaded config has not been published: %+v", cfg)
+	}
+	if app.Config.AppName != "test" {
+		t.Errorf("the config of the startup should be kept: %+v", app.Config)
+	}
+}
+
+func TestRegister_okReload(t *testing.T) {
+	defer func() { app = nil }()
+	defer stopConfigWatcher()
+	dir, err := ioutil.TempDir("", "krakend-newrelic")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "newrelic.yaml")
+	writeConfigFile(t, file, "appName: test\nlicense: \""+testLicense+"\"\nrate: 30\n")
+
+	registerNR(t, config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"appName": "inline",
+			"license": testLicense,
+			"rate":    100,
+			"reload":  map[string]interface{}{"file": file, "interval": "10ms"},
+		},
+	})
+	if app == nil {
+		t.Error("the app has not been registered")
+		return
+	}
+	if app.Config.AppName != "test" || app.Config.InstrumentationRate != 30 {
+		t.Errorf("unexpected config: %+v", app.Config)
+	}
+	if _, err := Middleware(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	writeConfigFile(t, file, "appName: test\nlicense: \""+testLicense+"\"\nrate: 5\n")
+	for i := 0; i < 100 && CurrentSettings().Rate != 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := CurrentSettings(); s.Rate != 5 {
+		t.Errorf("unexpected settings: %+v", s)
+	}
+}
+
+func TestRegisterService_okReload(t *testing.T) {
+	mu := new(sync.Mutex)
+	started := []string{}
+	defer func() {
+		app = nil
+		moduleLogger = logging.NoOp
+		newApplication = newrelic.NewApplication
+	}()
+	defer stopConfigWatcher()
+	newApplication = func(c newrelic.Config) (newrelic.Application, error) {
+		mu.Lock()
+		started = append(started, c.AppName)
+		mu.Unlock()
+		return newApp(), nil
+	}
+
+	dir, err := ioutil.TempDir("", "krakend-newrelic")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "newrelic.json")
+	writeConfigFile(t, file, `{"appName":"gw","license":"`+testLicense+`","rate":30,"rollups":["gw-all"]}`)
+
+	RegisterService(config.ServiceConfig{
+		Name: "gateway",
+		Port: 8080,
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"appName": "inline",
+				"license": testLicense,
+				"reload":  map[string]interface{}{"file": file, "interval": "10ms"},
+			},
+		},
+	}, logging.NoOp)
+	if app == nil {
+		t.Error("the app has not been registered")
+		return
+	}
+	if app.Config.AppName != "gw;gw-all" {
+		t.Errorf("unexpected app name: %s", app.Config.AppName)
+	}
+	if _, err := Middleware(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	writeConfigFile(t, file, `{"appName":"gw","license":"`+testLicense+`","rate":5,"rollups":["gw-all"]}`)
+	for i := 0; i < 100 && CurrentSettings().Rate != 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := CurrentSettings(); s.Rate != 5 {
+		t.Errorf("unexpected settings: %+v", s)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(started) != 1 || started[0] != "gw;gw-all" {
+		t.Errorf("the app should be started once with the rollups: %v", started)
+	}
+}
+
+func writeConfigFile(t *testing.T, file, content string) {
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Error(err)
+	}
+	// the changes are detected by the modification time and the size of the file
+	future := time.Now().Add(time.Duration(len(content)) * time.Second)
+	os.Chtimes(file, future, future)
+}
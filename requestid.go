@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/newrelic/go-agent"
+)
+
+const (
+	// DefaultRequestIDHeader is the header used for the request IDs if none is configured
+	DefaultRequestIDHeader = "X-Request-ID"
+
+	requestIDCtxKey    = "newRelicRequestID"
+	requestIDAttribute = "request.id"
+)
+
+// RequestIDConfig defines how the request IDs are read, generated and forwarded
+type RequestIDConfig struct {
+	// Header is the name of the header with the request ID, both in the request and in the
+	// requests to the backends
+	Header string `json:"header"`
+	// TraceIDHeader is the name of the response header for the trace ID. It is not added if empty
+	TraceIDHeader string `json:"traceIDHeader"`
+}
+
+func (r RequestIDConfig) header() string {
+	if r.Header == "" {
+		return DefaultRequestIDHeader
+	}
+	return r.Header
+}
+
+// ensureRequestID reads the request ID of the request or generates a new one, storing it
+// in the request headers and in the gin context
+func ensureRequestID(cfg RequestIDConfig, c *gin.Context) {
+	c.Set(requestIDCtxKey, requestIDFromRequest(cfg, c.Request))
+}
+
+// requestIDFromRequest returns the request ID of the request, generating and storing a new
+// one in the request headers if it is missing
+func requestIDFromRequest(cfg RequestIDConfig, r *http.Request) string {
+	header := cfg.header()
+	id := r.Header.Get(header)
+	if id == "" {
+		id = newRequestID()
+		r.Header.Set(header, id)
+	}
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDApplication decorates the application so the transactions get the request ID
+// as an attribute and, optionally, the trace ID is added to the response headers
+type requestIDApplication struct {
+	newrelic.Application
+	cfg RequestIDConfig
+}
+
+func (r requestIDApplication) StartTransaction(name string, w http.ResponseWriter, req *http.Request) newrelic.Transaction {
+	txn := r.Application.StartTransaction(name, w, req)
+	txn.AddAttribute(requestIDAttribute, req.Header.Get(r.cfg.header()))
+	if r.cfg.TraceIDHeader != "" && w != nil {
+		if traceID := txn.GetTraceMetadata().TraceID; traceID != "" {
+			w.Header().Set(r.cfg.TraceIDHeader, traceID)
+		}
+	}
+	return txn
+}
+
+// requestIDTransport forwards the request ID to the backends
+type requestIDTransport struct {
+	next   http.RoundTripper
+	header string
+	id     string
+}
+
+func (r requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get(r.header) != "" {
+		return r.next.RoundTrip(req)
+	}
+	// the round trippers must not modify the received request
+	clone := new(http.Request)
+	*clone = *req
+	clone.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		clone.Header[k] = v
+	}
+	clone.Header.Set(r.header, r.id)
+	return r.next.RoundTrip(clone)
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestMiddleware_okRequestID(t *testing.T) {
+	nrApp := newApp()
+	defer func() { app = nil }()
+	attributes := map[string]interface{}{}
+	nrApp.startTransaction = func(name string, w http.ResponseWriter, r *http.Request) newrelic.Transaction {
+		tx := newTx()
+		tx.addAttribute = func(key string, value interface{}) error {
+			attributes[key] = value
+			return nil
+		}
+		tx.getTraceMetadata = func() newrelic.TraceMetadata {
+			return newrelic.TraceMetadata{TraceID: "abc123", SpanID: "def456"}
+		}
+		return tx
+	}
+	app = &Application{nrApp, Config{
+		InstrumentationRate: 100,
+		RequestID: &RequestIDConfig{
+			Header:        "X-Correlation-ID",
+			TraceIDHeader: "X-Trace-ID",
+		},
+	}}
+
+	handler, err := Middleware()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+		return
+	}
+
+	var requestID string
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/my_endpoint", handler, func(c *gin.Context) {
+		requestID = c.GetHeader("X-Correlation-ID")
+		if v, _ := c.Get(requestIDCtxKey); v != requestID {
+			t.Errorf("unexpected request ID in the context: %v", v)
+		}
+		c.Status(http.StatusOK)
+	})
+
+	req, _ := http.NewRequest("GET", "/my_endpoint", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if len(requestID) != 32 {
+		t.Errorf("unexpected generated request ID: %s", requestID)
+	}
+	if attributes[requestIDAttribute] != requestID {
+		t.Errorf("unexpected request ID attribute: %v", attributes[requestIDAttribute])
+	}
+	if traceID := w.Header().Get("X-Trace-ID"); traceID != "abc123" {
+		t.Errorf("unexpected trace ID header: %s", traceID)
+	}
+
+	req, _ = http.NewRequest("GET", "/my_endpoint", nil)
+	req.Header.Set("X-Correlation-ID", "customer-42")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if requestID != "customer-42" {
+		t.Errorf("unexpected request ID: %s", requestID)
+	}
+	if attributes[requestIDAttribute] != "customer-42" {
+		t.Errorf("unexpected request ID attribute: %v", attributes[requestIDAttribute])
+	}
+}
+
+func TestHTTPClientFactory_okRequestID(t *testing.T) {
+	received := ""
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(DefaultRequestIDHeader)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	defer func() { app = nil }()
+	app = &Application{newApp(), Config{InstrumentationRate: 100, RequestID: &RequestIDConfig{}}}
+
+	ctx := context.WithValue(context.Background(), requestIDCtxKey, "abcdef")
+	client := HTTPClientFactory(func(_ context.Context) *http.Client { return &http.Client{} })(ctx)
+
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	resp.Body.Close()
+
+	if received != "abcdef" {
+		t.Errorf("unexpected request ID: %s", received)
+	}
+	if req.Header.Get(DefaultRequestIDHeader) != "" {
+		t.Error("the original request should not be modified")
+	}
+}
@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/newrelic/go-agent"
+)
+
+const (
+	defaultRetryAttempts   = 5
+	defaultRetryBackoff    = time.Second
+	defaultRetryMaxBackoff = time.Minute
+)
+
+var errPendingApp = fmt.Errorf("the NR app is not available yet")
+
+// transientError is a failure creating the app that may go away without changing the config,
+// like a CA bundle file not mounted yet. The rest of the failures are not retried
+type transientError struct {
+	error
+}
+
+func isTransient(err error) bool {
+	_, ok := err.(transientError)
+	return ok
+}
+
+// RetryConfig defines the retries of the creation of the NewRelic app after a transient failure.
+// The module is registered anyway, so the instrumentation starts as soon as the app is created
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of attempts, including the first one. Defaults to 5
+	MaxAttempts int `json:"maxAttempts"`
+	// Backoff is the time to wait before the first retry, doubled after every failed attempt.
+	// Defaults to 1s
+	Backoff string `json:"backoff"`
+	// MaxBackoff limits the time between attempts. Defaults to 1m
+	MaxBackoff string `json:"maxBackoff"`
+}
+
+func (r RetryConfig) validate() error {
+	if r.MaxAttempts < 0 {
+		return fmt.Errorf("invalid number of retry attempts %d", r.MaxAttempts)
+	}
+	for _, d := range []string{r.Backoff, r.MaxBackoff} {
+		if d == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d); err != nil || v <= 0 {
+			return fmt.Errorf("invalid retry backoff %s", d)
+		}
+	}
+	return nil
+}
+
+func (r RetryConfig) attempts() int {
+	if r.MaxAttempts == 0 {
+		return defaultRetryAttempts
+	}
+	return r.MaxAttempts
+}
+
+func (r RetryConfig) backoff() (time.Duration, time.Duration) {
+	backoff, maxBackoff := defaultRetryBackoff, defaultRetryMaxBackoff
+	if d, err := time.ParseDuration(r.Backoff); err == nil && d > 0 {
+		backoff = d
+	}
+	if d, err := time.ParseDuration(r.MaxBackoff); err == nil && d > 0 {
+		maxBackoff = d
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff, maxBackoff
+}
+
+// retry creates the app with exponential backoff, replacing the pending one when it succeeds.
+// The first attempt is the one already done by Register
+func (r RetryConfig) retry(conf Config, target reloadableApplication, logger logging.Logger) {
+	backoff, maxBackoff := r.backoff()
+	attempts := r.attempts()
+	for attempt := 2; attempt <= attempts; attempt++ {
+		time.Sleep(backoff)
+
+		nrApp, err := startApplication(conf)
+		if err == nil {
+			if !target.replacePending(nrApp) {
+				// the app has been created by a config reload meanwhile
+				nrApp.Shutdown(0)
+			}
+			logger.Info("NR module started after", attempt, "attempts")
+			return
+		}
+		if !isTransient(err) {
+			logger.Error("the NR module is disabled:", err.Error())
+			return
+		}
+		logger.Warning(fmt.Sprintf("unable to start the NR module (attempt %d of %d):", attempt, attempts), err.Error())
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	logger.Error("the NR module is disabled after", attempts, "failed attempts")
+}
+
+// appAvailable returns false while the creation of the app is being retried
+func appAvailable() bool {
+	r, ok := app.Application.(reloadableApplication)
+	if !ok {
+		return true
+	}
+	_, pending := r.load().(pendingApplication)
+	return !pending
+}
+
+// pendingApplication is the placeholder of the app while its creation is being retried. It
+// never starts transactions, since the middlewares skip the instrumentation meanwhile
+type pendingApplication struct{}
+
+func (pendingApplication) StartTransaction(_ string, _ http.ResponseWriter, _ *http.Request) newrelic.Transaction {
+	return nil
+}
+
+func (pendingApplication) RecordCustomEvent(_ string, _ map[string]interface{}) error {
+	return errPendingApp
+}
+
+func (pendingApplication) RecordCustomMetric(_ string, _ float64) error {
+	return errPendingApp
+}
+
+func (pendingApplication) WaitForConnection(_ time.Duration) error {
+	return errPendingApp
+}
+
+func (pendingApplication) Shutdown(_ time.Duration) {}
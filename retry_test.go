@@ -0,0 +1,276 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
+	"github.com/gin-gonic/gin"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestRegister_okRetry(t *testing.T) {
+	mu := new(sync.Mutex)
+	attempts := 0
+	transactions := 0
+	ready := make(chan struct{})
+
+	defer func() {
+		app = nil
+		moduleLogger = logging.NoOp
+		newApplication = newrelic.NewApplication
+	}()
+	newApplication = func(_ newrelic.Config) (newrelic.Application, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		defer close(ready)
+		nrApp := newApp()
+		nrApp.startTransaction = func(name string, w http.ResponseWriter, r *http.Request) newrelic.Transaction {
+			mu.Lock()
+			transactions++
+			mu.Unlock()
+			return newTx()
+		}
+		return nrApp, nil
+	}
+
+	dir, err := ioutil.TempDir("", "krakend-newrelic")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	caBundle := filepath.Join(dir, "ca.pem")
+
+	buff := &bytes.Buffer{}
+	logger, _ := logging.NewLogger("DEBUG", buff, "pref")
+	Register(config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"appName":      "test",
+			"license":      testLicense,
+			"rate":         100,
+			"caBundleFile": caBundle,
+			"retry":        map[string]interface{}{"maxAttempts": 1000, "backoff": "1ms", "maxBackoff": "1ms"},
+		},
+	}, logger)
+	if app == nil {
+		t.Error("the module should be registered")
+		return
+	}
+	if appAvailable() {
+		t.Error("the app should not be available until the CA bundle is")
+	}
+
+	mw, err := Middleware()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/my_endpoint", mw, func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	s := httptest.NewTLSServer(http.NotFoundHandler())
+	s.Close()
+	if err := ioutil.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Error("the app has not been created")
+		return
+	}
+	for i := 0; i < 100 && !appAvailable(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	req, _ := http.NewRequest("GET", "/my_endpoint", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if transactions != 1 {
+		t.Errorf("unexpected number of transactions: %d", transactions)
+	}
+	if attempts != 1 {
+		t.Errorf("unexpected number of attempts: %d", attempts)
+	}
+}
+
+func TestRegister_koRetryExhausted(t *testing.T) {
+	defer func() {
+		app = nil
+		moduleLogger = logging.NoOp
+		newApplication = newrelic.NewApplication
+	}()
+	newApplication = func(_ newrelic.Config) (newrelic.Application, error) {
+		t.Error("the app should not be created without the CA bundle")
+		return newApp(), nil
+	}
+
+	buff := &syncBuffer{}
+	logger, _ := logging.NewLogger("DEBUG", buff, "pref")
+	Register(config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"appName":      "test",
+			"license":      testLicense,
+			"rate":         100,
+			"caBundleFile": filepath.Join(os.TempDir(), "krakend-newrelic-unknown.pem"),
+			"retry":        map[string]interface{}{"maxAttempts": 2, "backoff": "1ms"},
+		},
+	}, logger)
+	if app == nil {
+		t.Error("the module should be registered")
+		return
+	}
+
+	mw, err := Middleware()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < 1000 && !strings.Contains(buff.String(), "failed attempts"); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/my_endpoint", mw, func(c *gin.Context) { c.Status(http.StatusTeapot) })
+	req, _ := http.NewRequest("GET", "/my_endpoint", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Result().StatusCode != http.StatusTeapot {
+		t.Errorf("unexpected status code: %d", w.Result().StatusCode)
+	}
+	if appAvailable() {
+		t.Error("the app should not be available")
+	}
+	if !strings.Contains(buff.String(), "the NR module is disabled after 2 failed attempts") {
+		t.Errorf("the exhausted retries have not been logged: %s", buff.String())
+	}
+}
+
+func TestRegister_koNoRetry(t *testing.T) {
+	defer func() {
+		app = nil
+		moduleLogger = logging.NoOp
+		newApplication = newrelic.NewApplication
+	}()
+	newApplication = func(_ newrelic.Config) (newrelic.Application, error) {
+		return nil, errors.New("unavailable")
+	}
+
+	buff := &bytes.Buffer{}
+	logger, _ := logging.NewLogger("DEBUG", buff, "pref")
+	Register(config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"appName": "test",
+			"license": testLicense,
+		},
+	}, logger)
+
+	if app != nil {
+		t.Error("the module should not be registered")
+	}
+	if !strings.Contains(buff.String(), "ERROR") {
+		t.Errorf("the failure has not been logged as an error: %s", buff.String())
+	}
+}
+
+func TestRegister_koInvalidConfig(t *testing.T) {
+	attempts := 0
+	defer func() {
+		app = nil
+		moduleLogger = logging.NoOp
+		newApplication = newrelic.NewApplication
+	}()
+	newApplication = func(_ newrelic.Config) (newrelic.Application, error) {
+		attempts++
+		return nil, errors.New("invalid license")
+	}
+
+	buff := &bytes.Buffer{}
+	logger, _ := logging.NewLogger("DEBUG", buff, "pref")
+	Register(config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"appName": "test",
+			"license": testLicense,
+			"retry":   map[string]interface{}{"maxAttempts": 5, "backoff": "1ms"},
+		},
+	}, logger)
+
+	if app != nil {
+		t.Error("the module should not be registered")
+	}
+	if attempts != 1 {
+		t.Errorf("the invalid config should not be retried: %d attempts", attempts)
+	}
+	if !strings.Contains(buff.String(), "ERROR") {
+		t.Errorf("the failure has not been logged as an error: %s", buff.String())
+	}
+}
+
+// syncBuffer is a buffer safe for the loggers used by the background retries
+type syncBuffer struct {
+	mu   sync.Mutex
+	buff bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buff.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buff.String()
+}
+
+func TestConfigGetter_koWrongRetry(t *testing.T) {
+	for _, retry := range []map[string]interface{}{
+		{"maxAttempts": -1},
+		{"backoff": "soon"},
+		{"maxBackoff": "0s"},
+	} {
+		cfg := config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"appName": "test",
+				"license": "123456",
+				"retry":   retry,
+			},
+		}
+		if _, err := ConfigGetter(cfg); err == nil {
+			t.Errorf("%v: it should have errored", retry)
+		}
+	}
+}
+
+func TestRetryConfig_okBackoff(t *testing.T) {
+	backoff, maxBackoff := RetryConfig{}.backoff()
+	if backoff != defaultRetryBackoff || maxBackoff != defaultRetryMaxBackoff {
+		t.Errorf("unexpected defaults: %s %s", backoff, maxBackoff)
+	}
+	backoff, maxBackoff = RetryConfig{Backoff: "1m", MaxBackoff: "10s"}.backoff()
+	if backoff != 10*time.Second || maxBackoff != 10*time.Second {
+		t.Errorf("unexpected backoff: %s %s", backoff, maxBackoff)
+	}
+}
@@ -2,47 +2,62 @@ package metrics
 
 import (
 	"fmt"
-	"math/rand"
+	"time"
 
 	"github.com/devopsfaith/krakend/config"
 	"github.com/devopsfaith/krakend/proxy"
 	krakendgin "github.com/devopsfaith/krakend/router/gin"
 	"github.com/gin-gonic/gin"
+	"github.com/newrelic/go-agent"
 	"github.com/newrelic/go-agent/_integrations/nrgin/v1"
 )
 
 var errNoApp = fmt.Errorf("No NewRelic app defined")
 
-// Middleware adds NewRelic middleware
+// Middleware adds NewRelic middleware, sampling the requests with the rate of their endpoint
 func Middleware() (gin.HandlerFunc, error) {
 	if app == nil {
 		return emptyMW, errNoApp
 	}
 
-	if app.Config.InstrumentationRate == 0 {
-		return emptyMW, nil
+	rules, err := newIgnoreRules(currentConfig().Ignore)
+	if err != nil {
+		return emptyMW, err
 	}
 
-	nrMiddleware := nrgin.Middleware(app)
-
-	if app.Config.InstrumentationRate == 100 {
-		return nrMiddleware, nil
+	var nrApp newrelic.Application = app
+	requestID := app.Config.RequestID
+	if requestID != nil {
+		nrApp = requestIDApplication{Application: app, cfg: *requestID}
 	}
 
-	rate := float64(app.Config.InstrumentationRate) / 100.0
+	nrMiddleware := nrgin.Middleware(nrApp)
+	apps := newAppRouter(app.Config, namedApps)
+	initSettings(rules)
 
-	next := make(chan float64, 1000)
-	go func(out chan<- float64) {
-		for {
-			out <- rand.Float64()
+	return func(c *gin.Context) {
+		if requestID != nil {
+			ensureRequestID(*requestID, c)
 		}
-	}(next)
+		count(counterRequests)
 
-	return func(c *gin.Context) {
-		if n := <-next; n <= rate {
-			nrMiddleware(c)
+		s := currentSettings()
+		var endpoint endpointRoute
+		if len(s.EndpointRates) > 0 || len(apps.apps) > 0 {
+			endpoint, _ = endpointRoutes.lookup(c.Request.Method, c.Request.URL.Path)
+		}
+		rate, mw := s.Rate, nrMiddleware
+		if routed := apps.route(c.Request, endpoint); routed != nil {
+			mw = routed.middleware
+			if routed.rate != nil {
+				rate = *routed.rate
+			}
+		}
+		if s.Enabled && appAvailable() && !isIgnored(s.rules, c.Request) && isSampled(s.endpointRate(endpoint.endpoint, rate)) {
+			mw(c)
 			return
 		}
+		c.Set(skippedCtxKey, true)
 		emptyMW(c)
 	}, nil
 }
@@ -54,15 +69,52 @@ func HandlerFactory(handlerFactory krakendgin.HandlerFactory) krakendgin.Handler
 	}
 	return func(conf *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
 		handler := handlerFactory(conf, p)
+		endpointCfg, err := EndpointConfigGetter(conf.ExtraConfig)
+		if err != nil {
+			moduleLogger.Error("invalid NR config for the endpoint", conf.Endpoint+":", err.Error())
+		}
+		name := newEndpointNamer(conf)
+		classifier, classifyStatus := endpointClassifier(conf)
+		apdex, hasApdex := endpointApdex(conf)
+		endpointRoutes.register(conf.Method, conf.Endpoint, endpointCfg.App)
 		return func(c *gin.Context) {
-			if txn := nrgin.Transaction(c); txn != nil {
-				txn.SetName(conf.Endpoint)
+			txn := nrgin.Transaction(c)
+			if txn == nil {
+				skipped, _ := c.Get(skippedCtxKey)
+				missingTransaction(skipped)
+				handler(c)
+				return
 			}
+			txn.SetName(name.name(c))
+			start := time.Now()
 			handler(c)
+			duration := time.Since(start)
+
+			if classifyStatus {
+				reportStatus(txn, classifier, c.Writer.Status())
+			}
+			if hasApdex {
+				apdex.report(txn, duration, classifier.classify(c.Writer.Status()) == statusError)
+			}
 		}
 	}
 }
 
+// transactionNamer returns the namer for the endpoint, giving priority to a valid endpoint
+// template over the global one and falling back to the endpoint pattern
+func transactionNamer(conf *config.EndpointConfig, template string) namer {
+	endpointCfg, _ := EndpointConfigGetter(conf.ExtraConfig)
+
+	if endpointCfg.TransactionName != "" {
+		template = endpointCfg.TransactionName
+	}
+
+	if name, err := newNamer(template, conf, endpointCfg.Label); err == nil {
+		return name
+	}
+	return literalNamer(conf.Endpoint)
+}
+
 func emptyMW(c *gin.Context) {
 	c.Next()
 }
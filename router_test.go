@@ -6,10 +6,12 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/logging"
 	"github.com/devopsfaith/krakend/proxy"
 	"github.com/gin-gonic/gin"
 	newrelic "github.com/newrelic/go-agent"
@@ -55,6 +57,70 @@ func TestMiddleware_ok(t *testing.T) {
 	}
 }
 
+func TestMiddleware_okIgnoredRequests(t *testing.T) {
+	totalCalls := 0
+	nrApp := newApp()
+	defer func() { app = nil }()
+	nrApp.startTransaction = func(name string, w http.ResponseWriter, r *http.Request) newrelic.Transaction {
+		totalCalls++
+		return newTx()
+	}
+
+	app = &Application{nrApp, Config{
+		InstrumentationRate: 100,
+		Ignore: IgnoreConfig{
+			Paths:      []string{"/__health"},
+			UserAgents: []string{"^ELB-HealthChecker/"},
+		},
+	}}
+	handler, err := Middleware()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(handler)
+	router.GET("/__health", func(c *gin.Context) {
+		if txn := nrgin.Transaction(c); txn != nil {
+			t.Error("unexpected transaction")
+		}
+		c.Status(http.StatusOK)
+	})
+	router.GET("/my_endpoint", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	for _, tc := range []struct {
+		path      string
+		userAgent string
+	}{
+		{path: "/__health"},
+		{path: "/my_endpoint", userAgent: "ELB-HealthChecker/2.0"},
+		{path: "/my_endpoint"},
+	} {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		req.Header.Set("User-Agent", tc.userAgent)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+	}
+
+	if totalCalls != 1 {
+		t.Errorf("unexpected number of calls to the txn generator. have: %d, wanted: 1", totalCalls)
+	}
+}
+
+func TestMiddleware_koWrongIgnoreRules(t *testing.T) {
+	defer func() { app = nil }()
+	app = &Application{newApp(), Config{
+		InstrumentationRate: 100,
+		Ignore:              IgnoreConfig{PathRegexps: []string{"(health"}},
+	}}
+	if _, err := Middleware(); err == nil {
+		t.Error("it should have errored")
+	}
+}
+
 func TestMiddleware_koNoApp(t *testing.T) {
 	app = nil
 	if _, err := Middleware(); err != errNoApp {
@@ -170,6 +236,117 @@ func TestHandlerFactory_okNRApp(t *testing.T) {
 	}
 }
 
+func TestHandlerFactory_okTransactionName(t *testing.T) {
+	nrApp := newApp()
+	defer func() { app = nil }()
+	names := []string{}
+	nrApp.startTransaction = func(name string, w http.ResponseWriter, r *http.Request) newrelic.Transaction {
+		tx := newTx()
+		tx.setName = func(name string) error {
+			names = append(names, name)
+			return nil
+		}
+		return tx
+	}
+	app = &Application{nrApp, Config{InstrumentationRate: 100, TransactionName: NamingMethodEndpoint}}
+
+	handler := func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Status(http.StatusTeapot)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	mw, err := Middleware()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	router.GET("/users/:id", mw, HandlerFactory(handler)(&config.EndpointConfig{
+		Endpoint: "/users/:id",
+	}, proxy.NoopProxy))
+	router.DELETE("/users/:id", mw, HandlerFactory(handler)(&config.EndpointConfig{
+		Endpoint: "/users/:id",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"transactionName": "{label} {endpoint}",
+				"label":           "removal",
+			},
+		},
+	}, proxy.NoopProxy))
+
+	for _, method := range []string{"GET", "DELETE"} {
+		req, _ := http.NewRequest(method, "/users/42", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+	}
+
+	if len(names) != 2 {
+		t.Errorf("unexpected number of names: %v", names)
+		return
+	}
+	if names[0] != "GET /users/:id" {
+		t.Errorf("unexpected name: %s", names[0])
+	}
+	if names[1] != "removal /users/:id" {
+		t.Errorf("unexpected name: %s", names[1])
+	}
+}
+
+func TestHandlerFactory_koWrongTransactionName(t *testing.T) {
+	nrApp := newApp()
+	defer func() {
+		app = nil
+		moduleLogger = logging.NoOp
+	}()
+	names := []string{}
+	nrApp.startTransaction = func(name string, w http.ResponseWriter, r *http.Request) newrelic.Transaction {
+		tx := newTx()
+		tx.setName = func(name string) error {
+			names = append(names, name)
+			return nil
+		}
+		return tx
+	}
+	app = &Application{nrApp, Config{InstrumentationRate: 100, TransactionName: NamingMethodEndpoint}}
+	buff := &bytes.Buffer{}
+	moduleLogger, _ = logging.NewLogger("DEBUG", buff, "pref")
+
+	handler := func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Status(http.StatusTeapot)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	mw, err := Middleware()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	router.GET("/users/:id", mw, HandlerFactory(handler)(&config.EndpointConfig{
+		Endpoint: "/users/:id",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"transactionName": "{method} {path}",
+			},
+		},
+	}, proxy.NoopProxy))
+
+	if !strings.Contains(buff.String(), "invalid NR config for the endpoint /users/:id") {
+		t.Errorf("the error should be logged: %s", buff.String())
+	}
+
+	req, _ := http.NewRequest("GET", "/users/42", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(names) != 1 || names[0] != "GET /users/:id" {
+		t.Errorf("unexpected names: %v", names)
+	}
+}
+
 type sampleApplication struct {
 	startTransaction   func(name string, w http.ResponseWriter, r *http.Request) newrelic.Transaction
 	recordCustomEvent  func(eventType string, params map[string]interface{}) error
@@ -210,9 +387,16 @@ type transaction struct {
 	noticeError                   func(err error) error
 	addAttribute                  func(key string, value interface{}) error
 	setWebRequest                 func(newrelic.WebRequest) error
+	setWebResponse                func(http.ResponseWriter) newrelic.Transaction
 	startSegmentNow               func() newrelic.SegmentStartTime
 	createDistributedTracePayload func() newrelic.DistributedTracePayload
 	acceptDistributedTracePayload func(t newrelic.TransportType, payload interface{}) error
+	application                   func() newrelic.Application
+	browserTimingHeader           func() (*newrelic.BrowserTimingHeader, error)
+	newGoroutine                  func() newrelic.Transaction
+	getTraceMetadata              func() newrelic.TraceMetadata
+	getLinkingMetadata            func() newrelic.LinkingMetadata
+	isSampled                     func() bool
 }
 
 func (tx transaction) End() error {
@@ -239,6 +423,13 @@ func (tx transaction) SetWebRequest(r newrelic.WebRequest) error {
 	return tx.SetWebRequest(r)
 }
 
+func (tx transaction) SetWebResponse(w http.ResponseWriter) newrelic.Transaction {
+	if tx.setWebResponse == nil {
+		return tx
+	}
+	return tx.setWebResponse(w)
+}
+
 func (tx transaction) StartSegmentNow() newrelic.SegmentStartTime {
 	return tx.startSegmentNow()
 }
@@ -251,6 +442,33 @@ func (tx transaction) AcceptDistributedTracePayload(t newrelic.TransportType, pa
 	return tx.acceptDistributedTracePayload(t, payload)
 }
 
+func (tx transaction) Application() newrelic.Application {
+	return tx.application()
+}
+
+func (tx transaction) BrowserTimingHeader() (*newrelic.BrowserTimingHeader, error) {
+	return tx.browserTimingHeader()
+}
+
+func (tx transaction) NewGoroutine() newrelic.Transaction {
+	if tx.newGoroutine == nil {
+		return tx
+	}
+	return tx.newGoroutine()
+}
+
+func (tx transaction) GetTraceMetadata() newrelic.TraceMetadata {
+	return tx.getTraceMetadata()
+}
+
+func (tx transaction) GetLinkingMetadata() newrelic.LinkingMetadata {
+	return tx.getLinkingMetadata()
+}
+
+func (tx transaction) IsSampled() bool {
+	return tx.isSampled()
+}
+
 func newTx() transaction {
 	return transaction{
 		ResponseWriter:                httptest.NewRecorder(),
@@ -263,6 +481,11 @@ func newTx() transaction {
 		startSegmentNow:               func() newrelic.SegmentStartTime { return newrelic.SegmentStartTime{} },
 		createDistributedTracePayload: func() newrelic.DistributedTracePayload { return payload },
 		acceptDistributedTracePayload: func(t newrelic.TransportType, payload interface{}) error { return nil },
+		application:                   func() newrelic.Application { return nil },
+		browserTimingHeader:           func() (*newrelic.BrowserTimingHeader, error) { return nil, nil },
+		getTraceMetadata:              func() newrelic.TraceMetadata { return newrelic.TraceMetadata{} },
+		getLinkingMetadata:            func() newrelic.LinkingMetadata { return newrelic.LinkingMetadata{} },
+		isSampled:                     func() bool { return true },
 	}
 }
 
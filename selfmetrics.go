@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/newrelic/go-agent"
+)
+
+// Names of the self-observability counters of the module
+const (
+	counterRequests           = "requests"
+	counterSampled            = "sampled"
+	counterDroppedBySampling  = "droppedBySampling"
+	counterIgnored            = "ignored"
+	counterMissingTransaction = "missingTransaction"
+	counterSegments           = "segments"
+	counterNoticedErrors      = "noticedErrors"
+
+	selfMetricsExpvarName      = "krakend_newrelic"
+	supportabilityMetricPrefix = "Supportability/KrakenD/"
+
+	skippedCtxKey = "newRelicSkipped"
+)
+
+var (
+	// selfMetrics exposes the counters of the module through expvar
+	selfMetrics = expvar.NewMap(selfMetricsExpvarName)
+
+	selfMetricsInterval = time.Minute
+	selfMetricsApp      = new(atomic.Value)
+	selfMetricsReporter = new(sync.Once)
+
+	newSegment = newrelic.StartSegment
+)
+
+func count(name string) {
+	selfMetrics.Add(name, 1)
+}
+
+// isIgnored applies the ignore rules, counting the ignored requests
+func isIgnored(rules *ignoreRules, r *http.Request) bool {
+	if rules.match(r) {
+		count(counterIgnored)
+		return true
+	}
+	return false
+}
+
+// isSampled takes the sampling decision, counting the requests sampled and dropped
+func isSampled(rate int) bool {
+	if !sample(rate) {
+		count(counterDroppedBySampling)
+		return false
+	}
+	count(counterSampled)
+	return true
+}
+
+// missingTransaction counts the requests reaching an instrumented layer without a transaction
+// in their context, unless the request was skipped on purpose by the middleware
+func missingTransaction(skipped interface{}) {
+	if skipped == nil {
+		count(counterMissingTransaction)
+	}
+}
+
+func counterValues() map[string]int64 {
+	values := map[string]int64{}
+	selfMetrics.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			values[kv.Key] = v.Value()
+		}
+	})
+	return values
+}
+
+func startSegment(tx newrelic.Transaction, name string) *newrelic.Segment {
+	if tx != nil {
+		count(counterSegments)
+	}
+	return newSegment(tx, name)
+}
+
+func noticeError(tx newrelic.Transaction, err error) {
+	count(counterNoticedErrors)
+	tx.NoticeError(err)
+}
+
+// startSelfMetricsReporter records the increments of the counters as custom metrics of the
+// application every minute. There is a single reporter, always using the last registered app
+func startSelfMetricsReporter(nrApp newrelic.Application) {
+	selfMetricsApp.Store(applicationRef{nrApp})
+	selfMetricsReporter.Do(func() {
+		go func() {
+			reported := map[string]int64{}
+			for range time.Tick(selfMetricsInterval) {
+				reportSelfMetrics(selfMetricsApp.Load().(applicationRef), reported)
+			}
+		}()
+	})
+}
+
+func reportSelfMetrics(nrApp newrelic.Application, reported map[string]int64) {
+	selfMetrics.Do(func(kv expvar.KeyValue) {
+		v, ok := kv.Value.(*expvar.Int)
+		if !ok {
+			return
+		}
+		total := v.Value()
+		if delta := total - reported[kv.Key]; delta > 0 {
+			nrApp.RecordCustomMetric(supportabilityMetricPrefix+kv.Key, float64(delta))
+		}
+		reported[kv.Key] = total
+	})
+}
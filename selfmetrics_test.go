@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/proxy"
+	"github.com/gin-gonic/gin"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestIsIgnored_ok(t *testing.T) {
+	rules, err := newIgnoreRules(IgnoreConfig{Paths: []string{"/__health"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	before := counterValues()[counterIgnored]
+
+	for path, expected := range map[string]bool{
+		"/__health":    true,
+		"/my_endpoint": false,
+	} {
+		req, _ := http.NewRequest("GET", path, nil)
+		if isIgnored(rules, req) != expected {
+			t.Errorf("unexpected result for %s", path)
+		}
+	}
+
+	if have := counterValues()[counterIgnored] - before; have != 1 {
+		t.Errorf("unexpected number of ignored requests. have: %d, want: 1", have)
+	}
+}
+
+func TestIsSampled_ok(t *testing.T) {
+	before := counterValues()
+
+	if !isSampled(100) {
+		t.Error("the request should be sampled")
+	}
+	if isSampled(0) {
+		t.Error("the request should be dropped")
+	}
+
+	after := counterValues()
+	for _, name := range []string{counterSampled, counterDroppedBySampling} {
+		if have := after[name] - before[name]; have != 1 {
+			t.Errorf("unexpected value of the counter %s. have: %d, want: 1", name, have)
+		}
+	}
+}
+
+func TestHandlerFactory_okMissingTransaction(t *testing.T) {
+	defer func() { app = nil }()
+	app = &Application{newApp(), Config{
+		InstrumentationRate: 100,
+		Ignore:              IgnoreConfig{Paths: []string{"/__health"}},
+	}}
+
+	mw, err := Middleware()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handler := HandlerFactory(func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) { c.Status(http.StatusOK) }
+	})(&config.EndpointConfig{Endpoint: "/my_endpoint"}, proxy.NoopProxy)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/__health", mw, handler)
+	router.GET("/my_endpoint", handler)
+
+	before := counterValues()[counterMissingTransaction]
+	for _, path := range []string{"/__health", "/my_endpoint"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if have := counterValues()[counterMissingTransaction] - before; have != 1 {
+		t.Errorf("unexpected number of missing transactions. have: %d, want: 1", have)
+	}
+}
+
+func TestSelfMetrics_okExpvar(t *testing.T) {
+	count(counterSegments)
+	if expvar.Get(selfMetricsExpvarName) == nil {
+		t.Error("the counters are not published")
+	}
+	if counterValues()[counterSegments] < 1 {
+		t.Error("unexpected value of the segments counter")
+	}
+}
+
+func TestReportSelfMetrics_ok(t *testing.T) {
+	metrics := map[string]float64{}
+	nrApp := newApp()
+	nrApp.recordCustomMetric = func(name string, value float64) error {
+		metrics[name] = value
+		return nil
+	}
+
+	reported := counterValues()
+	reported[counterNoticedErrors] -= 2
+	noticeError(newTx(), errNoApp)
+
+	reportSelfMetrics(nrApp, reported)
+
+	if len(metrics) != 1 {
+		t.Errorf("unexpected metrics: %v", metrics)
+	}
+	if v := metrics[supportabilityMetricPrefix+counterNoticedErrors]; v != 3 {
+		t.Errorf("unexpected value of the noticed errors metric: %f", v)
+	}
+
+	metrics = map[string]float64{}
+	reportSelfMetrics(nrApp, reported)
+	if len(metrics) != 0 {
+		t.Errorf("unexpected metrics: %v", metrics)
+	}
+}
+
+func TestStartSegment_ok(t *testing.T) {
+	before := counterValues()[counterSegments]
+
+	startSegment(nil, "foo").End()
+	tx := newTx()
+	tx.startSegmentNow = func() newrelic.SegmentStartTime { return newrelic.SegmentStartTime{} }
+	startSegment(tx, "foo").End()
+
+	if have := counterValues()[counterSegments] - before; have != 1 {
+		t.Errorf("unexpected number of segments. have: %d, want: 1", have)
+	}
+}
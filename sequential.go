@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/proxy"
+)
+
+const (
+	sequentialCtxKey = "newRelicSequentialSteps"
+
+	sequentialStepsAttribute    = "sequential.steps"
+	sequentialStepAttributeTmpl = "sequential.step.%d.duration"
+)
+
+var sequentialParamPattern = regexp.MustCompile(`(?i)resp\d+_[\w\.-]+`)
+
+// sequentialStep describes a backend of an endpoint using the KrakenD sequential proxy
+type sequentialStep struct {
+	index  int
+	params []string
+}
+
+func (s sequentialStep) segmentName() string {
+	if len(s.params) == 0 {
+		return fmt.Sprintf("step %d", s.index)
+	}
+	return fmt.Sprintf("step %d (%s)", s.index, strings.Join(s.params, ","))
+}
+
+// sequentialSteps returns the steps of the endpoint, if it uses the sequential proxy
+func sequentialSteps(cfg *config.EndpointConfig) (map[*config.Backend]sequentialStep, bool) {
+	v, ok := cfg.ExtraConfig[proxy.Namespace].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if sequential, ok := v["sequential"].(bool); !ok || !sequential || len(cfg.Backend) < 2 {
+		return nil, false
+	}
+
+	steps := make(map[*config.Backend]sequentialStep, len(cfg.Backend))
+	for i, backend := range cfg.Backend {
+		steps[backend] = sequentialStep{
+			index:  i,
+			params: propagatedParams(backend.URLPattern),
+		}
+	}
+	return steps, true
+}
+
+// propagatedParams returns the names of the params taken from previous responses
+func propagatedParams(urlPattern string) []string {
+	params := []string{}
+	seen := map[string]struct{}{}
+	for _, param := range sequentialParamPattern.FindAllString(urlPattern, -1) {
+		if _, ok := seen[param]; ok {
+			continue
+		}
+		seen[param] = struct{}{}
+		params = append(params, param)
+	}
+	return params
+}
+
+// newSequentialProxy injects the steps of the sequential endpoint into the context, so
+// the instrumented backends can record their step
+func newSequentialProxy(steps map[*config.Backend]sequentialStep, next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		tx, ok := lookupTransaction(ctx)
+		if !ok {
+			return next(ctx, req)
+		}
+		tx.AddAttribute(sequentialStepsAttribute, len(steps))
+		return next(context.WithValue(ctx, sequentialCtxKey, steps), req)
+	}
+}
+
+// newSequentialStep records a segment for the backend if it is a step of a sequential endpoint
+func newSequentialStep(cfg *config.Backend, next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		steps, ok := ctx.Value(sequentialCtxKey).(map[*config.Backend]sequentialStep)
+		if !ok {
+			return next(ctx, req)
+		}
+		step, ok := steps[cfg]
+		if !ok {
+			return next(ctx, req)
+		}
+		tx, ok := lookupTransaction(ctx)
+		if !ok {
+			return next(ctx, req)
+		}
+
+		start := time.Now()
+		segment := startSegment(tx, step.segmentName())
+		resp, err := next(ctx, req)
+		segment.End()
+		tx.AddAttribute(fmt.Sprintf(sequentialStepAttributeTmpl, step.index), time.Since(start).Seconds())
+
+		return resp, err
+	}
+}
@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/proxy"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestSequentialSteps_ok(t *testing.T) {
+	backends := []*config.Backend{
+		{URLPattern: "/users/{{.Id}}"},
+		{URLPattern: "/companies/{{.Resp0_company}}/offices/{{.Resp0_office.id}}"},
+		{URLPattern: "/owners/{{.Resp1_owner}}?company={{.Resp0_company}}"},
+	}
+
+	if _, ok := sequentialSteps(&config.EndpointConfig{Backend: backends}); ok {
+		t.Error("the endpoint is not sequential")
+	}
+
+	if _, ok := sequentialSteps(&config.EndpointConfig{
+		Backend: backends,
+		ExtraConfig: config.ExtraConfig{
+			proxy.Namespace: map[string]interface{}{"sequential": "true"},
+		},
+	}); ok {
+		t.Error("the endpoint is not sequential")
+	}
+
+	steps, ok := sequentialSteps(&config.EndpointConfig{
+		Backend: backends,
+		ExtraConfig: config.ExtraConfig{
+			proxy.Namespace: map[string]interface{}{"sequential": true},
+		},
+	})
+	if !ok {
+		t.Error("the endpoint is sequential")
+		return
+	}
+
+	for i, expected := range []sequentialStep{
+		{index: 0, params: []string{}},
+		{index: 1, params: []string{"Resp0_company", "Resp0_office.id"}},
+		{index: 2, params: []string{"Resp1_owner", "Resp0_company"}},
+	} {
+		if step := steps[backends[i]]; !reflect.DeepEqual(step, expected) {
+			t.Errorf("unexpected step %d. have: %v, want: %v", i, step, expected)
+		}
+	}
+
+	if name := steps[backends[1]].segmentName(); name != "step 1 (Resp0_company,Resp0_office.id)" {
+		t.Errorf("unexpected segment name: %s", name)
+	}
+	if name := steps[backends[0]].segmentName(); name != "step 0" {
+		t.Errorf("unexpected segment name: %s", name)
+	}
+}
+
+func TestProxyFactory_okSequential(t *testing.T) {
+	nrApp := newApp()
+	defer func() { app = nil }()
+	app = &Application{nrApp, Config{InstrumentationRate: 100}}
+
+	cfg := &config.EndpointConfig{
+		Endpoint: "/sequential",
+		Backend: []*config.Backend{
+			{URLPattern: "/users/{{.Id}}"},
+			{URLPattern: "/companies/{{.Resp0_company}}"},
+		},
+		ExtraConfig: config.ExtraConfig{
+			proxy.Namespace: map[string]interface{}{"sequential": true},
+		},
+	}
+
+	bf := BackendFactory("backend", func(_ *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{IsComplete: true}, nil
+		}
+	})
+
+	pf := proxy.FactoryFunc(func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+		backends := make([]proxy.Proxy, len(cfg.Backend))
+		for i, b := range cfg.Backend {
+			backends[i] = bf(b)
+		}
+		return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+			var resp *proxy.Response
+			var err error
+			for _, b := range backends {
+				if resp, err = b(ctx, req); err != nil {
+					return nil, err
+				}
+			}
+			return resp, nil
+		}, nil
+	})
+
+	totalSegments := 0
+	attributes := map[string]interface{}{}
+	txn := newTx()
+	txn.startSegmentNow = func() newrelic.SegmentStartTime {
+		totalSegments++
+		return newrelic.SegmentStartTime{}
+	}
+	txn.addAttribute = func(key string, value interface{}) error {
+		attributes[key] = value
+		return nil
+	}
+
+	p, err := ProxyFactory("proxy", pf)(cfg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+
+	if _, err := p(context.WithValue(context.Background(), nrCtxKey, txn), &proxy.Request{}); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+
+	// 1 for the proxy, 2 per step (the step and the backend)
+	if totalSegments != 5 {
+		t.Errorf("wrong number of segments, got: %d, wanted 5", totalSegments)
+	}
+	if attributes[sequentialStepsAttribute] != 2 {
+		t.Errorf("unexpected number of steps: %v", attributes[sequentialStepsAttribute])
+	}
+	for _, key := range []string{"sequential.step.0.duration", "sequential.step.1.duration"} {
+		if _, ok := attributes[key].(float64); !ok {
+			t.Errorf("missing attribute %s: %v", key, attributes)
+		}
+	}
+}
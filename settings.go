@@ -0,0 +1,175 @@
+package metrics
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// Settings are the instrumentation settings that can be changed at runtime
+type Settings struct {
+	// Enabled turns the instrumentation of the requests on and off
+	Enabled bool `json:"enabled"`
+	// Rate is the global sampling rate, as a percentage
+	Rate int `json:"rate"`
+	// EndpointRates are the sampling rates of the endpoints, overriding the global one and the
+	// ones of the named apps. The endpoints are known by the handlers created with HandlerFactory
+	EndpointRates map[string]int `json:"endpointRates,omitempty"`
+
+	rules           *ignoreRules
+	transactionName string
+	owner           *Application
+}
+
+// SettingsUpdate contains the settings to change. The nil fields are not modified and
+// the endpoint rates set to nil fall back to the global rate
+type SettingsUpdate struct {
+	Enabled       *bool           `json:"enabled"`
+	Rate          *int            `json:"rate"`
+	EndpointRates map[string]*int `json:"endpointRates"`
+}
+
+var (
+	errNoSettings = fmt.Errorf("the NR instrumentation is not initialized")
+
+	settings   = new(atomic.Value)
+	settingsMu = new(sync.Mutex)
+
+	randomFloats    = make(chan float64, 1000)
+	randomFloatsRun = new(sync.Once)
+)
+
+// initSettings publishes the settings defined in the config of the app. The settings already
+// published for the app are kept, so creating both the Middleware and the NewHTTPHandler does
+// not discard the changes made at runtime
+func initSettings(rules *ignoreRules) {
+	conf := currentConfig()
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+
+	if s := currentSettings(); s != nil && s.owner == app {
+		return
+	}
+	settings.Store(&Settings{
+		Enabled:         true,
+		Rate:            conf.InstrumentationRate,
+		rules:           rules,
+		transactionName: conf.TransactionName,
+		owner:           app,
+	})
+}
+
+// reloadSettings replaces the settings coming from the config, keeping the enabled state
+// and the endpoint rates
+func reloadSettings(conf Config, rules *ignoreRules) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+
+	if currentSettings() == nil {
+		return
+	}
+	next := CurrentSettings()
+	next.Rate = conf.InstrumentationRate
+	next.rules = rules
+	next.transactionName = conf.TransactionName
+	settings.Store(&next)
+}
+
+// CurrentSettings returns a copy of the runtime settings of the instrumentation
+func CurrentSettings() Settings {
+	s := currentSettings()
+	if s == nil {
+		return Settings{}
+	}
+	res := *s
+	res.EndpointRates = make(map[string]int, len(s.EndpointRates))
+	for k, v := range s.EndpointRates {
+		res.EndpointRates[k] = v
+	}
+	return res
+}
+
+// UpdateSettings applies the update to the runtime settings at once, so the requests get
+// either the previous settings or the updated ones
+func UpdateSettings(update SettingsUpdate) (Settings, error) {
+	if update.Rate != nil && !validRate(*update.Rate) {
+		return Settings{}, fmt.Errorf("invalid rate %d", *update.Rate)
+	}
+	for endpoint, rate := range update.EndpointRates {
+		if rate != nil && !validRate(*rate) {
+			return Settings{}, fmt.Errorf("invalid rate %d for the endpoint %s", *rate, endpoint)
+		}
+	}
+
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+
+	if currentSettings() == nil {
+		return Settings{}, errNoSettings
+	}
+	next := CurrentSettings()
+	if update.Enabled != nil {
+		next.Enabled = *update.Enabled
+	}
+	if update.Rate != nil {
+		next.Rate = *update.Rate
+	}
+	for endpoint, rate := range update.EndpointRates {
+		if rate == nil {
+			delete(next.EndpointRates, endpoint)
+			continue
+		}
+		next.EndpointRates[endpoint] = *rate
+	}
+	settings.Store(&next)
+
+	return CurrentSettings(), nil
+}
+
+func currentSettings() *Settings {
+	s, _ := settings.Load().(*Settings)
+	return s
+}
+
+// endpointRate returns the rate of the endpoint or the received one if it has no rate
+func (s *Settings) endpointRate(endpoint string, rate int) int {
+	if r, ok := s.EndpointRates[endpoint]; ok {
+		return r
+	}
+	return rate
+}
+
+// currentTransactionName returns the global naming template
+func currentTransactionName() string {
+	if s := currentSettings(); s != nil {
+		return s.transactionName
+	}
+	return currentConfig().TransactionName
+}
+
+func validRate(rate int) bool {
+	return rate >= 0 && rate <= 100
+}
+
+// sample decides if a request is sampled with the given rate
+func sample(rate int) bool {
+	if rate >= 100 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	return randomFloat() <= float64(rate)/100.0
+}
+
+func randomFloat() float64 {
+	randomFloatsRun.Do(func() {
+		go func(out chan<- float64) {
+			for {
+				out <- rand.Float64()
+			}
+		}(randomFloats)
+	})
+	return <-randomFloats
+}
@@ -0,0 +1,228 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/proxy"
+	"github.com/gin-gonic/gin"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestUpdateSettings_ok(t *testing.T) {
+	defer func() { app = nil }()
+	app = &Application{newApp(), Config{InstrumentationRate: 50}}
+	initSettings(new(ignoreRules))
+
+	enabled := false
+	rate := 10
+	endpointRate := 75
+	s, err := UpdateSettings(SettingsUpdate{
+		Enabled:       &enabled,
+		Rate:          &rate,
+		EndpointRates: map[string]*int{"/foo": &endpointRate, "/bar": &endpointRate},
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if s.Enabled || s.Rate != 10 || len(s.EndpointRates) != 2 {
+		t.Errorf("unexpected settings: %+v", s)
+	}
+	if r := currentSettings().endpointRate("/foo", 10); r != 75 {
+		t.Errorf("unexpected rate for /foo: %d", r)
+	}
+	if r := currentSettings().endpointRate("/unknown", s.Rate); r != 10 {
+		t.Errorf("unexpected rate for /unknown: %d", r)
+	}
+
+	s, err = UpdateSettings(SettingsUpdate{EndpointRates: map[string]*int{"/bar": nil}})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if s.Enabled || s.Rate != 10 || len(s.EndpointRates) != 1 || s.EndpointRates["/foo"] != 75 {
+		t.Errorf("unexpected settings: %+v", s)
+	}
+
+	// the returned settings are copies
+	s.EndpointRates["/foo"] = 1
+	if r := currentSettings().endpointRate("/foo", 10); r != 75 {
+		t.Errorf("unexpected rate for /foo: %d", r)
+	}
+}
+
+func TestInitSettings_okKeepRuntimeChanges(t *testing.T) {
+	defer func() { app = nil }()
+	app = &Application{newApp(), Config{InstrumentationRate: 50}}
+	initSettings(new(ignoreRules))
+
+	enabled := false
+	endpointRate := 5
+	if _, err := UpdateSettings(SettingsUpdate{Enabled: &enabled, EndpointRates: map[string]*int{"/foo": &endpointRate}}); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+
+	initSettings(new(ignoreRules))
+	if s := CurrentSettings(); s.Enabled || s.EndpointRates["/foo"] != 5 {
+		t.Errorf("the runtime changes should be kept: %+v", s)
+	}
+
+	app = &Application{newApp(), Config{InstrumentationRate: 50}}
+	initSettings(new(ignoreRules))
+	if s := CurrentSettings(); !s.Enabled || len(s.EndpointRates) != 0 {
+		t.Errorf("the settings of a new app should not have runtime changes: %+v", s)
+	}
+}
+
+func TestUpdateSettings_koWrongRates(t *testing.T) {
+	defer func() { app = nil }()
+	app = &Application{newApp(), Config{InstrumentationRate: 50}}
+	initSettings(new(ignoreRules))
+
+	for _, update := range []SettingsUpdate{
+		{Rate: intPtr(101)},
+		{Rate: intPtr(-1)},
+		{Rate: intPtr(10), EndpointRates: map[string]*int{"/foo": intPtr(200)}},
+	} {
+		if _, err := UpdateSettings(update); err == nil {
+			t.Errorf("the update %+v should have failed", update)
+		}
+	}
+
+	if s := CurrentSettings(); s.Rate != 50 || len(s.EndpointRates) != 0 {
+		t.Errorf("unexpected settings: %+v", s)
+	}
+}
+
+func TestUpdateSettings_okConcurrent(t *testing.T) {
+	defer func() { app = nil }()
+	app = &Application{newApp(), Config{InstrumentationRate: 50}}
+	initSettings(new(ignoreRules))
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(rate int) {
+			defer wg.Done()
+			UpdateSettings(SettingsUpdate{Rate: &rate, EndpointRates: map[string]*int{"/foo": &rate}})
+		}(i)
+		go func() {
+			defer wg.Done()
+			if s := currentSettings(); s.Rate != 50 && s.Rate != s.EndpointRates["/foo"] {
+				t.Errorf("partial update: %+v", s)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMiddleware_okRuntimeSettings(t *testing.T) {
+	names := []string{}
+	ignored := 0
+	started := 0
+	nrApp := newApp()
+	defer func() {
+		app = nil
+		endpointRoutes.reset()
+	}()
+	nrApp.startTransaction = func(name string, w http.ResponseWriter, r *http.Request) newrelic.Transaction {
+		started++
+		tx := newTx()
+		tx.setName = func(name string) error {
+			names = append(names, name)
+			return nil
+		}
+		tx.ignore = func() error {
+			ignored++
+			return nil
+		}
+		return tx
+	}
+	app = &Application{nrApp, Config{InstrumentationRate: 100}}
+
+	mw, err := Middleware()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handlerFactory := HandlerFactory(func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) { c.Status(http.StatusOK) }
+	})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(mw)
+	router.GET("/foo", handlerFactory(&config.EndpointConfig{Endpoint: "/foo"}, proxy.NoopProxy))
+	router.GET("/bar", handlerFactory(&config.EndpointConfig{Endpoint: "/bar"}, proxy.NoopProxy))
+
+	call := func() {
+		for _, path := range []string{"/foo", "/bar"} {
+			req, _ := http.NewRequest("GET", path, nil)
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	}
+
+	call()
+	if len(names) != 2 {
+		t.Errorf("unexpected transactions: %v", names)
+	}
+
+	if _, err := UpdateSettings(SettingsUpdate{Enabled: new(bool)}); err != nil {
+		t.Error(err)
+		return
+	}
+	call()
+	if len(names) != 2 {
+		t.Errorf("unexpected transactions: %v", names)
+	}
+
+	enabled := true
+	if _, err := UpdateSettings(SettingsUpdate{
+		Enabled:       &enabled,
+		EndpointRates: map[string]*int{"/foo": intPtr(0)},
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+	call()
+	if len(names) != 3 || names[2] != "/bar" {
+		t.Errorf("unexpected transactions: %v", names)
+	}
+	// the requests dropped by the endpoint rates never start a transaction
+	if started != 3 || ignored != 0 {
+		t.Errorf("unexpected number of transactions. started: %d, ignored: %d", started, ignored)
+	}
+
+	if _, err := UpdateSettings(SettingsUpdate{
+		Rate:          intPtr(0),
+		EndpointRates: map[string]*int{"/foo": intPtr(100)},
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+	call()
+	if len(names) != 4 || names[3] != "/foo" || started != 4 {
+		t.Errorf("unexpected transactions: %v", names)
+	}
+}
+
+func TestSample_ok(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if !sample(100) {
+			t.Error("the request should be sampled")
+		}
+		if sample(0) {
+			t.Error("the request should be dropped")
+		}
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -0,0 +1,201 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/proxy"
+	"github.com/newrelic/go-agent"
+)
+
+// StatusCodes classifies the response status codes. When it is defined in the global
+// config, the module reports the status code errors instead of the agent, so the codes
+// can be classified per endpoint and per backend.
+// Codes not listed are errors if they are 4xx or 5xx and the agent config does not ignore them.
+// The backends get the status code of the responses rejected by their status handler (like
+// the 404 rejected by the KrakenD default one) only if it is wrapped with StatusHandler
+type StatusCodes struct {
+	// Errors are always reported as errors
+	Errors []int `json:"errors"`
+	// Ignored are never reported
+	Ignored []int `json:"ignored"`
+	// Expected are recorded as attributes without affecting the error rate or the Apdex
+	Expected []int `json:"expected"`
+}
+
+type statusClass int
+
+const (
+	statusOK statusClass = iota
+	statusError
+	statusIgnored
+	statusExpected
+
+	statusClassAttribute        = "httpResponseCode.class"
+	backendStatusClassAttribute = "backend.httpResponseCode.class"
+	backendStatusCodeAttribute  = "backend.httpResponseCode"
+
+	statusCodeCtxKey = "newRelicBackendStatusCode"
+)
+
+func (s statusClass) String() string {
+	switch s {
+	case statusError:
+		return "error"
+	case statusIgnored:
+		return "ignored"
+	case statusExpected:
+		return "expected"
+	}
+	return "ok"
+}
+
+type statusClassifier struct {
+	errors   map[int]struct{}
+	ignored  map[int]struct{}
+	expected map[int]struct{}
+}
+
+func newStatusClassifier(codes StatusCodes, ignoredByAgent []int) statusClassifier {
+	ignored := toSet(ignoredByAgent)
+	for code := range toSet(codes.Ignored) {
+		ignored[code] = struct{}{}
+	}
+	return statusClassifier{
+		errors:   toSet(codes.Errors),
+		ignored:  ignored,
+		expected: toSet(codes.Expected),
+	}
+}
+
+func (s statusClassifier) classify(code int) statusClass {
+	if _, ok := s.expected[code]; ok {
+		return statusExpected
+	}
+	if _, ok := s.errors[code]; ok {
+		return statusError
+	}
+	if _, ok := s.ignored[code]; ok {
+		return statusIgnored
+	}
+	if code >= http.StatusBadRequest {
+		return statusError
+	}
+	return statusOK
+}
+
+// endpointClassifier returns the classifier for the endpoint and false if the module is not
+// in charge of the status code errors. In that case, the classifier mimics the agent
+func endpointClassifier(cfg *config.EndpointConfig) (statusClassifier, bool) {
+	endpointCfg, _ := EndpointConfigGetter(cfg.ExtraConfig)
+	return classifierFor(endpointCfg.StatusCodes)
+}
+
+// backendClassifier returns the classifier for the backend and false if the module is not
+// in charge of the status code errors. In that case, the classifier mimics the agent
+func backendClassifier(cfg *config.Backend) (statusClassifier, bool) {
+	backendCfg, _ := BackendConfigGetter(cfg.ExtraConfig)
+	return classifierFor(backendCfg.StatusCodes)
+}
+
+func classifierFor(local *StatusCodes) (statusClassifier, bool) {
+	if app.Config.StatusCodes == nil {
+		return newStatusClassifier(StatusCodes{}, app.Config.ErrorCollector.IgnoreStatusCodes), false
+	}
+	codes := app.Config.StatusCodes
+	if local != nil {
+		codes = local
+	}
+	return newStatusClassifier(*codes, app.Config.ErrorCollector.IgnoreStatusCodes), true
+}
+
+// StatusHandler wraps the status handler of the backends, so the status code of the responses
+// it rejects is still classified by the instrumented backends
+func StatusHandler(next proxy.HTTPStatusHandler) proxy.HTTPStatusHandler {
+	return func(ctx context.Context, resp *http.Response) (*http.Response, error) {
+		if code, ok := ctx.Value(statusCodeCtxKey).(*int); ok && resp != nil {
+			*code = resp.StatusCode
+		}
+		return next(ctx, resp)
+	}
+}
+
+// newBackendStatusClassifier reports the status code of the backend responses, if available,
+// as attributes of the backend
+func newBackendStatusClassifier(cfg *config.Backend, next proxy.Proxy) proxy.Proxy {
+	classifier, ok := backendClassifier(cfg)
+	if !ok {
+		return next
+	}
+	return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		code := new(int)
+		resp, err := next(context.WithValue(ctx, statusCodeCtxKey, code), req)
+		if resp != nil && resp.Metadata.StatusCode != 0 {
+			*code = resp.Metadata.StatusCode
+		}
+		if *code == 0 {
+			return resp, err
+		}
+
+		tx, ok := lookupTransaction(ctx)
+		if !ok {
+			return resp, err
+		}
+
+		class := classifier.classify(*code)
+		switch class {
+		case statusError:
+			noticeError(tx, statusCodeError{code: *code, backend: cfg.URLPattern})
+		case statusExpected:
+			addBackendAttribute(ctx, tx, backendStatusCodeAttribute, backendPath(cfg.URLPattern), *code)
+		}
+		addBackendAttribute(ctx, tx, backendStatusClassAttribute, backendPath(cfg.URLPattern), class.String())
+
+		return resp, err
+	}
+}
+
+func reportStatus(tx newrelic.Transaction, classifier statusClassifier, code int) {
+	class := classifier.classify(code)
+	if class == statusError {
+		noticeError(tx, statusCodeError{code: code})
+	}
+	tx.AddAttribute(statusClassAttribute, class.String())
+}
+
+type statusCodeError struct {
+	code    int
+	backend string
+}
+
+func (s statusCodeError) Error() string {
+	if s.backend == "" {
+		return http.StatusText(s.code)
+	}
+	return fmt.Sprintf("%s from backend %s", http.StatusText(s.code), s.backend)
+}
+
+// ErrorClass uses the status code as the class, as the agent does for its own status errors
+func (s statusCodeError) ErrorClass() string {
+	return strconv.Itoa(s.code)
+}
+
+// errorStatusCodes returns all the status codes the agent would report as errors
+func errorStatusCodes() []int {
+	codes := make([]int, 0, 200)
+	for code := http.StatusBadRequest; code < 600; code++ {
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+func toSet(codes []int) map[int]struct{} {
+	res := make(map[int]struct{}, len(codes))
+	for _, code := range codes {
+		res[code] = struct{}{}
+	}
+	return res
+}
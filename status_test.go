@@ -0,0 +1,238 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/devopsfaith/krakend/config"
+	"github.com/devopsfaith/krakend/encoding"
+	"github.com/devopsfaith/krakend/proxy"
+	"github.com/gin-gonic/gin"
+	newrelic "github.com/newrelic/go-agent"
+)
+
+func TestStatusClassifier_okClassify(t *testing.T) {
+	classifier := newStatusClassifier(StatusCodes{
+		Errors:   []int{302, 404},
+		Ignored:  []int{401},
+		Expected: []int{409},
+	}, []int{404, 429})
+
+	for code, expected := range map[int]statusClass{
+		200: statusOK,
+		302: statusError,
+		401: statusIgnored,
+		404: statusError,
+		409: statusExpected,
+		429: statusIgnored,
+		500: statusError,
+	} {
+		if class := classifier.classify(code); class != expected {
+			t.Errorf("%d: unexpected class. have: %s, want: %s", code, class, expected)
+		}
+	}
+}
+
+func TestHandlerFactory_okStatusCodes(t *testing.T) {
+	nrApp := newApp()
+	defer func() { app = nil }()
+	errs := []error{}
+	attributes := map[string]interface{}{}
+	nrApp.startTransaction = func(name string, w http.ResponseWriter, r *http.Request) newrelic.Transaction {
+		tx := newTx()
+		tx.noticeError = func(err error) error {
+			errs = append(errs, err)
+			return nil
+		}
+		tx.addAttribute = func(key string, value interface{}) error {
+			attributes[key] = value
+			return nil
+		}
+		return tx
+	}
+	app = &Application{nrApp, Config{InstrumentationRate: 100, StatusCodes: &StatusCodes{}}}
+
+	handler := func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Status(http.StatusNotFound)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	mw, err := Middleware()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	router.GET("/lookup", mw, HandlerFactory(handler)(&config.EndpointConfig{
+		Endpoint: "/lookup",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"statusCodes": map[string]interface{}{
+					"expected": []int{404},
+				},
+			},
+		},
+	}, proxy.NoopProxy))
+	router.GET("/users", mw, HandlerFactory(handler)(&config.EndpointConfig{
+		Endpoint: "/users",
+	}, proxy.NoopProxy))
+
+	req, _ := http.NewRequest("GET", "/lookup", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if attributes[statusClassAttribute] != "expected" {
+		t.Errorf("unexpected status class: %v", attributes[statusClassAttribute])
+	}
+
+	req, _ = http.NewRequest("GET", "/users", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(errs) != 1 {
+		t.Errorf("unexpected errors: %v", errs)
+		return
+	}
+	if errs[0].(statusCodeError).ErrorClass() != "404" {
+		t.Errorf("unexpected error class: %s", errs[0].(statusCodeError).ErrorClass())
+	}
+	if attributes[statusClassAttribute] != "error" {
+		t.Errorf("unexpected status class: %v", attributes[statusClassAttribute])
+	}
+}
+
+func TestNewBackendStatusClassifier_ok(t *testing.T) {
+	defer func() { app = nil }()
+	app = &Application{newApp(), Config{InstrumentationRate: 100, StatusCodes: &StatusCodes{Expected: []int{404}}}}
+
+	cfg := &config.Backend{
+		URLPattern: "/internal/users",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"statusCodes": map[string]interface{}{
+					"errors": []int{404},
+				},
+			},
+		},
+	}
+
+	errs := []error{}
+	txn := newTx()
+	txn.noticeError = func(err error) error {
+		errs = append(errs, err)
+		return nil
+	}
+
+	p := newBackendStatusClassifier(cfg, func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{Metadata: proxy.Metadata{StatusCode: http.StatusNotFound}}, nil
+	})
+
+	if _, err := p(context.WithValue(context.Background(), nrCtxKey, txn), nil); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+
+	if len(errs) != 1 {
+		t.Errorf("unexpected errors: %v", errs)
+		return
+	}
+	if errs[0].Error() != "Not Found from backend /internal/users" {
+		t.Errorf("unexpected error: %s", errs[0].Error())
+	}
+}
+
+func TestNewBackendStatusClassifier_okHTTPProxyDetailed(t *testing.T) {
+	defer func() { app = nil }()
+	app = &Application{newApp(), Config{InstrumentationRate: 100, StatusCodes: &StatusCodes{}}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.NotFound(w, nil)
+	}))
+	defer server.Close()
+
+	errs := []error{}
+	txn := newTx()
+	txn.noticeError = func(err error) error {
+		errs = append(errs, err)
+		return nil
+	}
+
+	remote := &config.Backend{URLPattern: "/internal/users", Host: []string{server.URL}, Decoder: encoding.JSONDecoder}
+	rp := proxy.DefaultHTTPResponseParserFactory(proxy.HTTPResponseParserConfig{
+		Decoder:         remote.Decoder,
+		EntityFormatter: proxy.NewEntityFormatter(remote),
+	})
+	for _, tc := range []struct {
+		statusHandler proxy.HTTPStatusHandler
+		errs          int
+	}{
+		{statusHandler: proxy.DefaultHTTPStatusHandler, errs: 0},
+		{statusHandler: StatusHandler(proxy.DefaultHTTPStatusHandler), errs: 1},
+	} {
+		errs = []error{}
+		p := proxy.NewHTTPProxyDetailed(remote, proxy.DefaultHTTPRequestExecutor(proxy.NewHTTPClient), tc.statusHandler, rp)
+		if _, err := newBackendStatusClassifier(remote, p)(context.WithValue(context.Background(), nrCtxKey, txn), &proxy.Request{}); err != proxy.ErrInvalidStatusCode {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if len(errs) != tc.errs {
+			t.Errorf("unexpected errors: %v", errs)
+		}
+	}
+	if len(errs) == 1 && errs[0].Error() != "Not Found from backend /internal/users" {
+		t.Errorf("unexpected error: %s", errs[0].Error())
+	}
+}
+
+func TestNewBackendStatusClassifier_okNotInCharge(t *testing.T) {
+	defer func() { app = nil }()
+	app = &Application{newApp(), Config{InstrumentationRate: 100}}
+
+	calls := 0
+	next := func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		calls++
+		return nil, nil
+	}
+
+	newBackendStatusClassifier(&config.Backend{}, next)(context.Background(), nil)
+	if calls != 1 {
+		t.Errorf("unexpected number of calls: %d", calls)
+	}
+}
+
+func TestNewBackendStatusClassifier_okFanOut(t *testing.T) {
+	defer func() { app = nil }()
+	app = &Application{newApp(), Config{InstrumentationRate: 100, StatusCodes: &StatusCodes{Expected: []int{404}}}}
+
+	attributes := map[string]interface{}{}
+	txn := newTx()
+	txn.addAttribute = func(key string, value interface{}) error {
+		attributes[key] = value
+		return nil
+	}
+	ctx := context.WithValue(context.Background(), nrCtxKey, txn)
+
+	for pattern, code := range map[string]int{"/lookup": http.StatusNotFound, "internal": http.StatusOK} {
+		code := code
+		p := newBackendStatusClassifier(&config.Backend{URLPattern: pattern}, func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{Metadata: proxy.Metadata{StatusCode: code}}, nil
+		})
+		p(ctx, nil)
+	}
+
+	for attribute, expected := range map[string]interface{}{
+		"backend.httpResponseCode.class[/lookup]":   "expected",
+		"backend.httpResponseCode[/lookup]":         http.StatusNotFound,
+		"backend.httpResponseCode.class[/internal]": "ok",
+	} {
+		if attributes[attribute] != expected {
+			t.Errorf("unexpected %s: %v", attribute, attributes[attribute])
+		}
+	}
+	if len(attributes) != 3 {
+		t.Errorf("unexpected attributes: %v", attributes)
+	}
+}